@@ -1,22 +1,47 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
-	"encoding/csv"
+	"context"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"math/rand"
 	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
+	"os/signal"
 	"regexp"
+	"runtime/debug"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	_ "time/tzdata" // --timezone を zoneinfo のないコンテナでも使えるようにする
+	"unicode"
 )
 
-const endpoint = "https://api.github.com/graphql"
+const defaultEndpoint = "https://api.github.com/graphql"
+
+// リリースビルドでは -ldflags "-X main.version=v1.2.3" で上書きする
+var version = ""
+
+func toolVersion() string {
+	if version != "" {
+		return version
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok && bi.Main.Version != "" {
+		return bi.Main.Version
+	}
+	return "(devel)"
+}
 
 type graphQLRequest struct {
 	Query     string                 `json:"query"`
@@ -28,15 +53,149 @@ type pageInfo struct {
 	EndCursor   string `json:"endCursor"`
 }
 
+type gqlError struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+func joinGQLErrors(errs []gqlError) error {
+	msgs := make([]string, 0, len(errs))
+	for _, e := range errs {
+		msgs = append(msgs, e.Message)
+	}
+	return errors.New(strings.Join(msgs, "; "))
+}
+
+// 重いクエリで 200 + errors[].type == "TIMEOUT" が返ることがある
+func hasTimeoutError(errs []gqlError) bool {
+	for _, e := range errs {
+		if strings.EqualFold(e.Type, "TIMEOUT") {
+			return true
+		}
+	}
+	return false
+}
+
+// HTTP 200 の errors で返るレート制限 ("You have exceeded a secondary rate limit" / "API rate limit exceeded")
+func hasRateLimitError(errs []gqlError) bool {
+	for _, e := range errs {
+		msg := strings.ToLower(e.Message)
+		if strings.EqualFold(e.Type, "RATE_LIMITED") || strings.Contains(msg, "secondary rate limit") || strings.Contains(msg, "api rate limit exceeded") {
+			return true
+		}
+	}
+	return false
+}
+
+// errs がレート制限なら待ってから true を返す (呼び出し側は同じカーソルで取り直す)。retries は呼び出し側の連続回数で、
+// retryBackoff.Attempts を超えたら待たずに false を返してエラーにさせる。
+// 二次制限には待ち時間のヘッダーがないので 1 分 + バックオフ待つ
+func waitGQLRateLimit(ctx context.Context, what string, errs []gqlError, retries *int) (bool, error) {
+	if !hasRateLimitError(errs) || *retries >= retryBackoff.Attempts {
+		return false, nil
+	}
+	wait := time.Minute + retryBackoff.delay(*retries)
+	*retries++
+	warnf("%s: %v; pausing %s before retrying (%d/%d)\n", what, joinGQLErrors(errs), wait.Round(time.Second), *retries, retryBackoff.Attempts)
+	if err := sleepCtx(ctx, wait); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// 一覧には見えるが PR を読めないリポジトリ (errors[].type == "FORBIDDEN")
+var errNoPRAccess = errors.New("no-pr-access")
+
+func hasForbiddenError(errs []gqlError) bool {
+	for _, e := range errs {
+		if strings.EqualFold(e.Type, "FORBIDDEN") {
+			return true
+		}
+	}
+	return false
+}
+
+// 名前を指定した repo が存在しない・見えない (errors[].type == "NOT_FOUND")
+var errRepoNotFound = errors.New("not-found")
+
+func hasNotFoundError(errs []gqlError) bool {
+	for _, e := range errs {
+		if strings.EqualFold(e.Type, "NOT_FOUND") {
+			return true
+		}
+	}
+	return false
+}
+
+// スキャン対象のリポジトリ。--org に複数指定できるので名前だけでは一意にならない
+type repoRef struct {
+	Org  string
+	Name string
+}
+
+func (r repoRef) String() string { return r.Org + "/" + r.Name }
+
+// --repos-file の1行。"org/name" ならその org、名前だけなら --org が1つのときのみ受け付ける
+func parseRepoRef(s string, orgs []string) (repoRef, error) {
+	if o, name, ok := strings.Cut(s, "/"); ok {
+		if o == "" || name == "" {
+			return repoRef{}, fmt.Errorf("invalid repo %q (want name or org/name)", s)
+		}
+		return repoRef{Org: o, Name: name}, nil
+	}
+	if len(orgs) != 1 {
+		return repoRef{}, fmt.Errorf("repo %q needs an org/ prefix when --org lists several orgs", s)
+	}
+	return repoRef{Org: orgs[0], Name: s}, nil
+}
+
+type skippedRepo struct {
+	Repo   repoRef
+	Reason string
+}
+
 type prNode struct {
-	Number      int       `json:"number"`
-	MergedAt    time.Time `json:"mergedAt"`
-	Additions   int       `json:"additions"`
-	Deletions   int       `json:"deletions"`
-	BaseRefName string    `json:"baseRefName"`
-	Author      struct {
+	Number       int       `json:"number"`
+	State        string    `json:"state"`
+	MergedAt     time.Time `json:"mergedAt"`
+	CreatedAt    time.Time `json:"createdAt"`
+	UpdatedAt    time.Time `json:"updatedAt"`
+	Additions    int       `json:"additions"`
+	Deletions    int       `json:"deletions"`
+	ChangedFiles int       `json:"changedFiles"`
+	BaseRefName  string    `json:"baseRefName"`
+	Author       *struct {
 		Login string `json:"login"`
-	} `json:"author"`
+	} `json:"author"` // 削除済みアカウント (ghost) は null
+	MergedBy *struct {
+		Login string `json:"login"`
+	} `json:"mergedBy"`
+	Milestone *struct {
+		Title string `json:"title"`
+	} `json:"milestone"`
+	AuthorAssociation string `json:"authorAssociation"`
+	ReviewDecision    string `json:"reviewDecision"` // APPROVED / CHANGES_REQUESTED / REVIEW_REQUIRED / null
+	ReviewThreads     *struct {
+		Nodes []struct {
+			IsResolved bool `json:"isResolved"`
+		} `json:"nodes"`
+	} `json:"reviewThreads"` // --require-resolved-threads のときのみ取得
+	Files *struct {
+		Nodes []prFile `json:"nodes"`
+	} `json:"files"` // ファイル単位の行数が必要なときのみ取得
+	Labels *struct {
+		Nodes []struct {
+			Name string `json:"name"`
+		} `json:"nodes"`
+	} `json:"labels"` // ラベルで絞り込むときのみ取得 (先頭 20 件)
+	Reviews *struct {
+		Nodes []struct {
+			Author *struct {
+				Login string `json:"login"`
+			} `json:"author"`
+			State string `json:"state"` // APPROVED / CHANGES_REQUESTED / COMMENTED / DISMISSED / PENDING
+		} `json:"nodes"`
+	} `json:"reviews"` // --include-reviews のときのみ取得 (先頭 50 件)
 }
 
 type prResp struct {
@@ -47,37 +206,630 @@ type prResp struct {
 				Nodes    []prNode `json:"nodes"`
 			} `json:"pullRequests"`
 		} `json:"repository"`
+		RateLimit *gqlRateLimit `json:"rateLimit"`
 	} `json:"data"`
-	Errors []struct {
-		Message string `json:"message"`
-	} `json:"errors"`
+	Errors []gqlError `json:"errors"`
+}
+
+// 一覧で取得したリポジトリ
+type repoInfo struct {
+	Name       string `json:"name"`
+	IsFork     bool   `json:"isFork"`
+	IsArchived bool   `json:"isArchived"`
+	IsPrivate  bool   `json:"isPrivate"`
 }
 
+// organization / user のどちらも "owner" エイリアスで受ける。見つからなければ Owner は nil
 type reposResp struct {
 	Data struct {
-		Organization struct {
+		Owner *struct {
 			Repositories struct {
+				PageInfo pageInfo   `json:"pageInfo"`
+				Nodes    []repoInfo `json:"nodes"`
+			} `json:"repositories"`
+		} `json:"owner"`
+		RateLimit *gqlRateLimit `json:"rateLimit"`
+	} `json:"data"`
+	Errors []gqlError `json:"errors"`
+}
+
+// クエリに含めた rateLimit { cost remaining resetAt }
+type gqlRateLimit struct {
+	Cost      int       `json:"cost"`
+	Remaining int       `json:"remaining"`
+	ResetAt   time.Time `json:"resetAt"`
+}
+
+type ownerTypeResp struct {
+	Data struct {
+		RepositoryOwner *struct {
+			Typename string `json:"__typename"`
+		} `json:"repositoryOwner"`
+	} `json:"data"`
+	Errors []gqlError `json:"errors"`
+}
+
+type refsResp struct {
+	Data struct {
+		Repository struct {
+			Refs struct {
 				PageInfo pageInfo `json:"pageInfo"`
 				Nodes    []struct {
-					Name       string `json:"name"`
-					IsFork     bool   `json:"isFork"`
-					IsArchived bool   `json:"isArchived"`
-					IsPrivate  bool   `json:"isPrivate"`
+					Name string `json:"name"`
 				} `json:"nodes"`
-			} `json:"repositories"`
-		} `json:"organization"`
+			} `json:"refs"`
+		} `json:"repository"`
 	} `json:"data"`
-	Errors []struct {
-		Message string `json:"message"`
-	} `json:"errors"`
+	Errors []gqlError `json:"errors"`
 }
 
 type agg struct {
-	Additions int
-	Deletions int
-	PRs       int
+	Additions   int
+	Deletions   int
+	PRs         int
+	Files       int // changedFiles の合計
+	Milestones  map[string]bool
+	Weeks       map[string]bool // マージがあった週の開始日 (月曜, YYYY-MM-DD)
+	LeadHours   []float64       // 作成→マージの時間 (h)。どちらかの時刻が欠けている PR は含めない
+	PRSizes     []float64       // PR ごとの touched lines (additions + |deletions|)
+	WeekdayPRs  int             // マージ日時 (reportLoc) が平日
+	WeekendPRs  int             // マージ日時 (reportLoc) が土日
+	EmptyPRs    int             // touched lines が 0 の PR (--min-lines で除外したものも含む)
+	Raw         []prNode        // 集計した PR そのもの (prFilter.KeepRaw のときのみ)
+	Decisions   map[string]int  // reviewDecision ごとの PR 数 (null は "")
+	Reviews     map[string]int  // レビューした PR 数 (review state ごと、同じ PR は state ごとに1回)
+	Daily       map[string]int  // マージ日 (reportLoc, YYYY-MM-DD) ごとの touched lines
+	FirstMerged time.Time       // 集計した PR の最古の mergedAt
+	LastMerged  time.Time       // 集計した PR の最新の mergedAt
+	Periods     map[string]*agg // 期間ラベルごとの内訳 (prFilter.Period 指定時のみ)
+}
+
+// b の集計を a に足し込む
+func (a *agg) merge(b *agg) {
+	a.Additions += b.Additions
+	a.Deletions += b.Deletions
+	a.PRs += b.PRs
+	a.Files += b.Files
+	for k := range b.Milestones {
+		if a.Milestones == nil {
+			a.Milestones = map[string]bool{}
+		}
+		a.Milestones[k] = true
+	}
+	for k := range b.Weeks {
+		if a.Weeks == nil {
+			a.Weeks = map[string]bool{}
+		}
+		a.Weeks[k] = true
+	}
+	a.LeadHours = append(a.LeadHours, b.LeadHours...)
+	a.PRSizes = append(a.PRSizes, b.PRSizes...)
+	a.WeekdayPRs += b.WeekdayPRs
+	a.WeekendPRs += b.WeekendPRs
+	a.EmptyPRs += b.EmptyPRs
+	a.Raw = append(a.Raw, b.Raw...)
+	for k, v := range b.Decisions {
+		if a.Decisions == nil {
+			a.Decisions = map[string]int{}
+		}
+		a.Decisions[k] += v
+	}
+	for k, v := range b.Reviews {
+		if a.Reviews == nil {
+			a.Reviews = map[string]int{}
+		}
+		a.Reviews[k] += v
+	}
+	for k, v := range b.Daily {
+		if a.Daily == nil {
+			a.Daily = map[string]int{}
+		}
+		a.Daily[k] += v
+	}
+	if b.LastMerged.After(a.LastMerged) {
+		a.LastMerged = b.LastMerged
+	}
+	if !b.FirstMerged.IsZero() && (a.FirstMerged.IsZero() || b.FirstMerged.Before(a.FirstMerged)) {
+		a.FirstMerged = b.FirstMerged
+	}
+	for k, v := range b.Periods {
+		if a.Periods == nil {
+			a.Periods = map[string]*agg{}
+		}
+		t := a.Periods[k]
+		if t == nil {
+			t = &agg{}
+			a.Periods[k] = t
+		}
+		t.merge(v)
+	}
+}
+
+func (a *agg) add(n prNode) {
+	a.Additions += n.Additions
+	a.Deletions += n.Deletions
+	a.PRs += 1
+	a.Files += n.ChangedFiles
+	if n.Milestone != nil && n.Milestone.Title != "" {
+		if a.Milestones == nil {
+			a.Milestones = map[string]bool{}
+		}
+		a.Milestones[n.Milestone.Title] = true
+	}
+	// 以下の週・日・曜日・マージ日時の集計はマージ済みの PR のみ (--states で OPEN / CLOSED を含めた場合)
+	if !n.MergedAt.IsZero() {
+		if a.Weeks == nil {
+			a.Weeks = map[string]bool{}
+		}
+		a.Weeks[weekStart(n.MergedAt).Format("2006-01-02")] = true
+	}
+	if !n.CreatedAt.IsZero() && !n.MergedAt.IsZero() {
+		a.LeadHours = append(a.LeadHours, n.MergedAt.Sub(n.CreatedAt).Hours())
+	}
+	a.PRSizes = append(a.PRSizes, float64(n.Additions+abs(n.Deletions)))
+	if a.Decisions == nil {
+		a.Decisions = map[string]int{}
+	}
+	a.Decisions[n.ReviewDecision]++
+	if n.MergedAt.IsZero() {
+		return
+	}
+	if a.Daily == nil {
+		a.Daily = map[string]int{}
+	}
+	a.Daily[n.MergedAt.In(reportLoc).Format("2006-01-02")] += n.Additions + abs(n.Deletions)
+	if n.MergedAt.After(a.LastMerged) {
+		a.LastMerged = n.MergedAt
+	}
+	if a.FirstMerged.IsZero() || n.MergedAt.Before(a.FirstMerged) {
+		a.FirstMerged = n.MergedAt
+	}
+	switch n.MergedAt.In(reportLoc).Weekday() {
+	case time.Saturday, time.Sunday:
+		a.WeekendPRs++
+	default:
+		a.WeekdayPRs++
+	}
+}
+
+// PR単位のフィルタ条件
+type prFilter struct {
+	Since     time.Time
+	Until     time.Time
+	Milestone string // 空なら絞り込みなし。大文字小文字は区別しない
+	// Since / Until を比べる時刻: merged | created | updated (--date-field)。空なら merged
+	DateField string
+	// 取得する PR の state (MERGED / CLOSED / OPEN)。空なら MERGED のみ
+	States []string
+	// authorAssociation の許可リスト (大文字)。空なら絞り込みなし
+	Associations map[string]bool
+	// 著者 login の許可リスト (小文字)。空なら絞り込みなし
+	Authors map[string]bool
+	// bot とみなす著者 login。nil なら除外しない ("[bot]" で終わる login は常に bot 扱い)
+	Bots *regexp.Regexp
+	// 同じ PR 番号を2回以上数えない
+	Dedupe bool
+	// レビュースレッドがすべて resolved の PR のみ (スレッドなしは resolved 扱い)
+	RequireResolvedThreads bool
+	// ラベル名 (小文字)。Include が空でなければいずれかを持つ PR のみ、Exclude のいずれかを持つ PR は除く
+	IncludeLabels map[string]bool
+	ExcludeLabels map[string]bool
+	// touched lines がこれ未満の PR は数えない (--min-lines)
+	MinLines int
+	// MinLines で落とした 0 行の PR も agg.EmptyPRs に数える (--with-empty-prs)
+	CountDroppedEmpty bool
+	// 著者ではなくマージした人の login で集計する (--group-by merger)。絞り込み条件は著者のまま
+	GroupByMerger bool
+	// login が取れない PR・レビュー ((ghost) / (unknown)) を数えない (--drop-unknown-authors)
+	DropUnknownAuthors bool
+	// month|week|day なら mergedAt (reportLoc) の期間ごとの内訳も agg.Periods に持つ (--bucket)
+	Period string
+	// 集計した PR を agg.Raw に残す (--raw-out 用)
+	KeepRaw bool
+	// .gitattributes の linguist-generated に一致するファイルの行数を除く
+	RespectGitattributes bool
+	// 空でなければパスがこれで始まるファイルの行数だけを数え、一致するファイルがない PR は除く (--path-prefix)
+	PathPrefix string
+	// ファイルパスの glob。Include が空でなければいずれかに一致するファイル、Exclude のいずれかに一致するファイルは除く
+	IncludePaths []pathPattern
+	ExcludePaths []pathPattern
+	// 集計した PR のレビューをレビュアーの login ごとに agg.Reviews に数える (--include-reviews)
+	IncludeReviews bool
+}
+
+// GitHub の CommentAuthorAssociation の値
+var authorAssociations = []string{
+	"OWNER", "MEMBER", "COLLABORATOR", "CONTRIBUTOR",
+	"FIRST_TIME_CONTRIBUTOR", "FIRST_TIMER", "MANNEQUIN", "NONE",
+}
+
+func (n prNode) authorLogin() string {
+	if n.Author == nil {
+		return ""
+	}
+	return n.Author.Login
+}
+
+const (
+	// author / mergedBy が null (アカウントが削除済み)
+	ghostLogin = "(ghost)"
+	// オブジェクトはあるが login が空など、それ以外で login が取れない
+	unknownLogin = "(unknown)"
+)
+
+// PR を集計する login (--group-by merger ならマージした人)。取れなければ (ghost) / (unknown)
+func (f prFilter) loginOf(n prNode) string {
+	if f.GroupByMerger {
+		switch {
+		case n.MergedBy != nil && n.MergedBy.Login != "":
+			return n.MergedBy.Login
+		case n.MergedBy == nil && !n.MergedAt.IsZero():
+			return ghostLogin
+		}
+		return unknownLogin
+	}
+	switch {
+	case n.Author == nil:
+		return ghostLogin
+	case n.Author.Login == "":
+		return unknownLogin
+	}
+	return n.Author.Login
+}
+
+// 集計対象外ならその理由 (skipped-by-*) と判定に使った値を返す。対象なら ""
+func (f prFilter) skipReason(n prNode) (string, string) {
+	if t := f.dateOf(n); !inRange(t, f.Since, f.Until) {
+		return "skipped-by-date", fmt.Sprintf("%sAt=%s since=%s until=%s", f.dateField(), fmtBound(t), fmtBound(f.Since), fmtBound(f.Until))
+	}
+	if f.Milestone != "" {
+		if n.Milestone == nil {
+			return "skipped-by-milestone", fmt.Sprintf("milestone=(none) want=%q", f.Milestone)
+		}
+		if !strings.EqualFold(n.Milestone.Title, f.Milestone) {
+			return "skipped-by-milestone", fmt.Sprintf("milestone=%q want=%q", n.Milestone.Title, f.Milestone)
+		}
+	}
+	if len(f.Associations) > 0 && !f.Associations[n.AuthorAssociation] {
+		return "skipped-by-association", fmt.Sprintf("authorAssociation=%s", n.AuthorAssociation)
+	}
+	if f.Bots != nil && (strings.HasSuffix(n.authorLogin(), "[bot]") || f.Bots.MatchString(n.authorLogin())) {
+		return "skipped-by-bot", fmt.Sprintf("author=%s", n.authorLogin())
+	}
+	if len(f.Authors) > 0 && !f.Authors[strings.ToLower(n.authorLogin())] {
+		return "skipped-by-author", fmt.Sprintf("author=%s", n.authorLogin())
+	}
+	if f.DropUnknownAuthors {
+		if login := f.loginOf(n); login == ghostLogin || login == unknownLogin {
+			return "skipped-by-unknown-author", fmt.Sprintf("login=%s", login)
+		}
+	}
+	if f.RequireResolvedThreads && n.ReviewThreads != nil {
+		unresolved := 0
+		for _, t := range n.ReviewThreads.Nodes {
+			if !t.IsResolved {
+				unresolved++
+			}
+		}
+		if unresolved > 0 {
+			return "skipped-by-threads", fmt.Sprintf("unresolved=%d", unresolved)
+		}
+	}
+	if f.filtersPaths() && n.ChangedFiles == 0 {
+		return "skipped-by-path", "no matching files"
+	}
+	if f.needsLabels() {
+		included := len(f.IncludeLabels) == 0
+		var names []string
+		if n.Labels != nil {
+			for _, l := range n.Labels.Nodes {
+				name := strings.ToLower(l.Name)
+				names = append(names, l.Name)
+				if f.ExcludeLabels[name] {
+					return "skipped-by-label", fmt.Sprintf("excluded label=%s", l.Name)
+				}
+				if f.IncludeLabels[name] {
+					included = true
+				}
+			}
+		}
+		if !included {
+			return "skipped-by-label", fmt.Sprintf("labels=%s", strings.Join(names, ";"))
+		}
+	}
+	if touched := n.Additions + abs(n.Deletions); touched < f.MinLines {
+		return "skipped-by-size", fmt.Sprintf("touched=%d min=%d", touched, f.MinLines)
+	}
+	return "", ""
 }
 
+func (f prFilter) dateField() string {
+	if f.DateField == "" {
+		return "merged"
+	}
+	return f.DateField
+}
+
+// 期間の判定と --bucket に使う PR の時刻。未マージの PR の mergedAt はゼロ値
+func (f prFilter) dateOf(n prNode) time.Time {
+	switch f.DateField {
+	case "created":
+		return n.CreatedAt
+	case "updated":
+		return n.UpdatedAt
+	}
+	return n.MergedAt
+}
+
+func (f prFilter) states() []string {
+	if len(f.States) == 0 {
+		return []string{"MERGED"}
+	}
+	return f.States
+}
+
+func (f prFilter) wantsState(state string) bool {
+	for _, s := range f.states() {
+		if s == state {
+			return true
+		}
+	}
+	return false
+}
+
+// PR ごとのファイル一覧 (files) が必要か
+func (f prFilter) needsFiles() bool {
+	return f.RespectGitattributes || f.filtersPaths()
+}
+
+// ファイルパスで行数を絞り込むか
+func (f prFilter) filtersPaths() bool {
+	return f.PathPrefix != "" || len(f.IncludePaths) > 0 || len(f.ExcludePaths) > 0
+}
+
+func (f prFilter) matchesPath(file string) bool {
+	if !strings.HasPrefix(file, f.PathPrefix) {
+		return false
+	}
+	for _, p := range f.ExcludePaths {
+		if p.match(file) {
+			return false
+		}
+	}
+	if len(f.IncludePaths) == 0 {
+		return true
+	}
+	for _, p := range f.IncludePaths {
+		if p.match(file) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f prFilter) needsLabels() bool {
+	return len(f.IncludeLabels) > 0 || len(f.ExcludeLabels) > 0
+}
+
+func fmtBound(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
+
+// --exclude-bots で除外した PR 数 (repo は並行に走査されるので atomic)
+var botPRsExcluded atomic.Int64
+
+// --explain 有効時の出力先 (nil なら無効)。repo は並行に走査されるので 1 行ずつ explainMu の下で書く
+var (
+	explainOut io.Writer
+	explainMu  sync.Mutex
+)
+
+func explainPR(owner, repo string, n prNode, decision, detail string) {
+	if explainOut == nil {
+		return
+	}
+	line := fmt.Sprintf("EXPLAIN %s/%s#%d base=%s author=%s +%d/-%d: %s",
+		owner, repo, n.Number, n.BaseRefName, n.authorLogin(), n.Additions, n.Deletions, decision)
+	if detail != "" {
+		line += fmt.Sprintf(" (%s)", detail)
+	}
+	explainMu.Lock()
+	defer explainMu.Unlock()
+	io.WriteString(explainOut, line+"\n")
+}
+
+// --states。GraphQL の PullRequestState の値 (大文字) に揃える
+func parseStates(s string) ([]string, error) {
+	var states []string
+	seen := map[string]bool{}
+	for _, v := range splitList(s) {
+		v = strings.ToUpper(v)
+		switch v {
+		case "MERGED", "CLOSED", "OPEN":
+		default:
+			return nil, fmt.Errorf("unknown state %q (want MERGED, CLOSED or OPEN)", v)
+		}
+		if !seen[v] {
+			seen[v] = true
+			states = append(states, v)
+		}
+	}
+	if len(states) == 0 {
+		return nil, errors.New("no states given")
+	}
+	return states, nil
+}
+
+func parseAssociations(s string) (map[string]bool, error) {
+	set := map[string]bool{}
+	for _, v := range splitList(s) {
+		v = strings.ToUpper(v)
+		known := false
+		for _, a := range authorAssociations {
+			if a == v {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown author association %q (want one of %s)", v, strings.Join(authorAssociations, ","))
+		}
+		set[v] = true
+	}
+	return set, nil
+}
+
+// カンマ区切りを分割し、空要素を除いて trim する
+func splitList(s string) []string {
+	var out []string
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+type row struct {
+	Org       string `json:"org"`
+	Repo      string `json:"repo"`
+	RepoGroup string `json:"repo_group,omitempty"`
+	User      string `json:"user"`
+	Name      string `json:"name,omitempty"` // --identity-map の表示名 (未登録なら login)
+	Team      string `json:"team,omitempty"`
+	Period    string `json:"period,omitempty"`
+	Additions int    `json:"additions"`
+	Deletions int    `json:"deletions"`
+	Net       int    `json:"net"` // additions - deletions (負になりうる)
+	PRs       int    `json:"prs"`
+	Files     int    `json:"files"`
+	Score     int    `json:"score"`
+	Milestone string `json:"milestone,omitempty"`
+
+	ActiveWeeks int     `json:"active_weeks"`
+	Consistency float64 `json:"consistency"`
+
+	LeadSamples     int     `json:"lead_samples"`
+	AvgLeadHours    float64 `json:"avg_lead_time_hours"`
+	MedianLeadHours float64 `json:"median_lead_time_hours"`
+
+	MedianPRSize float64 `json:"median_pr_size"`
+	P90PRSize    int     `json:"p90_pr_size"`
+	MaxPRSize    int     `json:"max_pr_size"`
+
+	WeekdayPRs int `json:"weekday_prs"`
+	WeekendPRs int `json:"weekend_prs"`
+
+	EmptyPRs int `json:"empty_prs"`
+
+	Decisions map[string]int `json:"review_decisions,omitempty"`
+	Reviews   map[string]int `json:"reviews,omitempty"`
+
+	FirstMerged time.Time `json:"first_merged"`
+	LastMerged  time.Time `json:"last_merged"`
+
+	// org 合算の分布における百分位 (0-100)
+	AdditionsPctl int `json:"additions_pctl"`
+	DeletionsPctl int `json:"deletions_pctl"`
+	ScorePctl     int `json:"score_pctl"`
+}
+
+type sortKey struct {
+	Field string
+	Desc  bool
+}
+
+// 数値列は降順、文字列列は昇順がデフォルト
+var sortFields = map[string]bool{
+	"score":     true,
+	"additions": true,
+	"deletions": true,
+	"prs":       true,
+	"org":       false,
+	"repo":      false,
+	"user":      false,
+	"period":    false,
+}
+
+// spec: "additions,deletions:asc,user" のようなカンマ区切り。各キーに :asc / :desc を付けられる
+func parseSortKeys(spec string) ([]sortKey, error) {
+	var keys []sortKey
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		field, dir, _ := strings.Cut(part, ":")
+		field = strings.ToLower(field)
+		desc, ok := sortFields[field]
+		if !ok {
+			return nil, fmt.Errorf("unknown sort key %q", field)
+		}
+		switch strings.ToLower(dir) {
+		case "":
+		case "asc":
+			desc = false
+		case "desc":
+			desc = true
+		default:
+			return nil, fmt.Errorf("unknown sort direction %q for key %q", dir, field)
+		}
+		keys = append(keys, sortKey{Field: field, Desc: desc})
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("empty sort spec")
+	}
+	return keys, nil
+}
+
+// -1: a が先, 1: b が先, 0: 同順
+func compareRows(a, b row, keys []sortKey) int {
+	for _, k := range keys {
+		var c int
+		switch k.Field {
+		case "score":
+			c = cmpInt(a.Score, b.Score)
+		case "additions":
+			c = cmpInt(a.Additions, b.Additions)
+		case "deletions":
+			c = cmpInt(a.Deletions, b.Deletions)
+		case "prs":
+			c = cmpInt(a.PRs, b.PRs)
+		case "org":
+			c = strings.Compare(a.Org, b.Org)
+		case "repo":
+			c = strings.Compare(a.Repo, b.Repo)
+		case "user":
+			c = strings.Compare(a.User, b.User)
+		case "period":
+			c = strings.Compare(a.Period, b.Period)
+		}
+		if k.Desc {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+func cmpInt(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// 日付だけの --since / --until、--bucket の期間、曜日・日・週の集計に使うタイムゾーン (--timezone)
+var reportLoc = time.UTC
+
 func mustParseTimeOrZero(s string) time.Time {
 	if s == "" {
 		return time.Time{}
@@ -88,15 +840,74 @@ func mustParseTimeOrZero(s string) time.Time {
 		"2006-01-02T15:04:05Z07:00",
 		"2006-01-02",
 	}
+	// オフセットのない日付だけの形式は reportLoc の 0:00
 	for _, l := range layouts {
-		if t, err := time.Parse(l, s); err == nil {
+		if t, err := time.ParseInLocation(l, s, reportLoc); err == nil {
 			return t
 		}
 	}
-	fmt.Fprintf(os.Stderr, "WARN: cannot parse time %q, ignoring filter\n", s)
+	warnf("cannot parse time %q, ignoring filter\n", s)
 	return time.Time{}
 }
 
+// --until 用。日付だけ (2006-01-02) ならその日の終わり (reportLoc の 23:59:59.999999999) まで含める
+func mustParseUntilOrZero(s string) time.Time {
+	t := mustParseTimeOrZero(s)
+	if _, err := time.Parse("2006-01-02", s); err == nil {
+		// 夏時間の切り替え日は 24 時間ではないので日付で進める
+		return t.AddDate(0, 0, 1).Add(-time.Nanosecond)
+	}
+	return t
+}
+
+// ファイルや secret 由来の末尾改行などを除去する。途中に空白を含むものは壊れているとみなす
+func normalizeToken(raw string) (string, error) {
+	t := strings.TrimSpace(raw)
+	if strings.IndexFunc(t, unicode.IsSpace) >= 0 {
+		return "", errors.New("contains whitespace inside the value; check how it is exported")
+	}
+	return t, nil
+}
+
+// トークンの取得元。--token-file > GITHUB_ACCESS_TOKEN > GITHUB_TOKEN > GH_TOKEN の順で最初に値があるものを使う。
+// source はメッセージ用の取得元の名前
+func resolveToken(tokenFile string) (token, source string, err error) {
+	if tokenFile != "" {
+		source = "--token-file " + tokenFile
+		b, err := os.ReadFile(tokenFile)
+		if err != nil {
+			return "", source, err
+		}
+		token, err = normalizeToken(string(b))
+		return token, source, err
+	}
+	for _, name := range []string{"GITHUB_ACCESS_TOKEN", "GITHUB_TOKEN", "GH_TOKEN"} {
+		if v := os.Getenv(name); v != "" {
+			token, err = normalizeToken(v)
+			return token, name, err
+		}
+	}
+	return "", "GITHUB_ACCESS_TOKEN", nil
+}
+
+// 既知のトークン形式に見えなければ警告文を返す（401 の原因調査用のヒント）
+func tokenFormatWarning(t string) string {
+	prefixes := []string{"ghp_", "gho_", "ghu_", "ghs_", "ghr_", "github_pat_"}
+	for _, p := range prefixes {
+		if strings.HasPrefix(t, p) {
+			if len(t) < len(p)+30 {
+				return fmt.Sprintf("looks truncated (%d chars)", len(t))
+			}
+			return ""
+		}
+	}
+	// 旧形式の 40 桁 hex
+	if len(t) == 40 && strings.Trim(t, "0123456789abcdefABCDEF") == "" {
+		return ""
+	}
+	return fmt.Sprintf("does not look like a GitHub token (%d chars, unknown prefix); requests may fail with 401", len(t))
+}
+
 func inRange(t, since, until time.Time) bool {
 	if !since.IsZero() && t.Before(since) {
 		return false
@@ -107,54 +918,402 @@ func inRange(t, since, until time.Time) bool {
 	return true
 }
 
-func doGraphQL(token string, q string, vars map[string]interface{}) ([]byte, error) {
-	body, _ := json.Marshal(graphQLRequest{Query: q, Variables: vars})
-	req, _ := http.NewRequest("POST", endpoint, bytes.NewReader(body))
-	req.Header.Set("Authorization", "Bearer "+token)
-	req.Header.Set("Accept", "application/vnd.github+json")
-	req.Header.Set("Content-Type", "application/json")
+// リトライ対象の HTTP ステータス (--retry-statuses で変更)
+var retryStatuses = mustParseStatusSet("429,500-599")
 
-	client := &http.Client{Timeout: 30 * time.Second}
+type statusRange struct{ lo, hi int }
 
-	var lastErr error
-	for attempt := 0; attempt < 5; attempt++ {
-		resp, err := client.Do(req)
+type statusSet []statusRange
+
+func (s statusSet) has(code int) bool {
+	for _, r := range s {
+		if code >= r.lo && code <= r.hi {
+			return true
+		}
+	}
+	return false
+}
+
+// "429,500-599,502" のような単一コードと範囲のカンマ区切り
+func parseStatusSet(spec string) (statusSet, error) {
+	var set statusSet
+	for _, part := range splitList(spec) {
+		lo, hi, isRange := strings.Cut(part, "-")
+		a, err := strconv.Atoi(strings.TrimSpace(lo))
 		if err != nil {
-			lastErr = err
-			time.Sleep(time.Duration(300*(attempt+1)) * time.Millisecond)
-			continue
+			return nil, fmt.Errorf("invalid status %q", part)
 		}
-		defer resp.Body.Close()
-		b, _ := io.ReadAll(resp.Body)
-		if resp.StatusCode >= 500 && resp.StatusCode <= 599 {
-			lastErr = fmt.Errorf("server %d: %s", resp.StatusCode, string(b))
-			time.Sleep(time.Duration(500*(attempt+1)) * time.Millisecond)
-			continue
+		b := a
+		if isRange {
+			if b, err = strconv.Atoi(strings.TrimSpace(hi)); err != nil {
+				return nil, fmt.Errorf("invalid status range %q", part)
+			}
 		}
-		if resp.StatusCode == 401 || resp.StatusCode == 403 {
-			return nil, fmt.Errorf("auth/rate error %d: %s", resp.StatusCode, string(b))
+		if a < 100 || b > 599 || a > b {
+			return nil, fmt.Errorf("invalid status range %q", part)
 		}
-		return b, nil
+		set = append(set, statusRange{a, b})
 	}
-	return nil, lastErr
+	return set, nil
 }
 
-// visibility: all|public|private
-func fetchOrgRepos(token, org string, includeForks, includeArchived bool, visibility string, maxRepos int) ([]string, error) {
-	const reposQuery = `
-query($org:String!, $cursor:String, $privacy: RepositoryPrivacy) {
-  organization(login:$org) {
-    repositories(
-      first:100,
-      after:$cursor,
-      orderBy:{field: NAME, direction: ASC},
-      privacy:$privacy
-    ) {
+func mustParseStatusSet(spec string) statusSet {
+	s, err := parseStatusSet(spec)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// Retry-After は秒数か HTTP-date
+func retryAfter(h http.Header) (time.Duration, bool) {
+	v := strings.TrimSpace(h.Get("Retry-After"))
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		d := time.Until(t)
+		if d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+	return 0, false
+}
+
+// 403/429 がレート制限かどうかと、次に試すまでの待ち時間。
+// Retry-After (二次制限) > X-RateLimit-Remaining: 0 + X-RateLimit-Reset (一次制限) > 本文のメッセージ の順に見る。
+// false ならトークン不正や権限不足などの本当の認証エラー
+func rateLimitWait(status int, h http.Header, body []byte) (time.Duration, bool) {
+	if status != 403 && status != 429 {
+		return 0, false
+	}
+	if d, ok := retryAfter(h); ok {
+		return d, true
+	}
+	if strings.TrimSpace(h.Get("X-RateLimit-Remaining")) == "0" {
+		if reset, err := strconv.ParseInt(strings.TrimSpace(h.Get("X-RateLimit-Reset")), 10, 64); err == nil {
+			d := time.Until(time.Unix(reset, 0)) + time.Second
+			if d < 0 {
+				d = 0
+			}
+			return d, true
+		}
+	}
+	msg := strings.ToLower(string(body))
+	if strings.Contains(msg, "rate limit") || strings.Contains(msg, "abuse") {
+		// ヘッダーがない二次制限は 1 分以上待つよう案内されている
+		return time.Minute, true
+	}
+	return 0, false
+}
+
+// "query RepoBranches($owner:...)" の RepoBranches。名前のないクエリは "(anonymous)"
+func operationName(q string) string {
+	q = strings.TrimSpace(q)
+	if !strings.HasPrefix(q, "query") {
+		return "(anonymous)"
+	}
+	name := strings.TrimSpace(q[len("query"):])
+	if i := strings.IndexAny(name, "({ \n"); i >= 0 {
+		name = name[:i]
+	}
+	if name == "" {
+		return "(anonymous)"
+	}
+	return name
+}
+
+// 実行中の API 呼び出し回数とレート制限ヘッダーの記録 (終了時の要約用)。doGraphQL が並行に呼ぶので mu で守る
+type rateStats struct {
+	mu        sync.Mutex
+	Requests  int       // HTTP リクエスト数 (再試行を含む、キャッシュヒットは含まない)
+	Limit     int       // X-RateLimit-Limit
+	Remaining int       // X-RateLimit-Remaining (最も少なかった値)
+	Reset     time.Time // X-RateLimit-Reset (最も新しい値)
+	Cost      int       // クエリの rateLimit.cost の合計 (rateLimit を含むクエリのみ)
+	// X-RateLimit-Used の増分。リセットをまたいだ分は窓ごとに足す。
+	// 各窓の最初のレスポンスより前の消費は分からないので概算 (下限) になる
+	used        int
+	windowFirst int
+	windowLast  int
+	seen        bool
+}
+
+var apiStats rateStats
+
+func (s *rateStats) record(h http.Header) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Requests++
+	limit, err1 := strconv.Atoi(strings.TrimSpace(h.Get("X-RateLimit-Limit")))
+	remaining, err2 := strconv.Atoi(strings.TrimSpace(h.Get("X-RateLimit-Remaining")))
+	used, err3 := strconv.Atoi(strings.TrimSpace(h.Get("X-RateLimit-Used")))
+	resetUnix, err4 := strconv.ParseInt(strings.TrimSpace(h.Get("X-RateLimit-Reset")), 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
+		return
+	}
+	reset := time.Unix(resetUnix, 0)
+	switch {
+	case !s.seen || reset.After(s.Reset):
+		// 新しい窓。前の窓の分を確定させる
+		s.used += s.windowLast - s.windowFirst
+		s.windowFirst, s.windowLast = used, used
+		s.Reset, s.Remaining = reset, remaining
+	case reset.Equal(s.Reset):
+		if used < s.windowFirst {
+			s.windowFirst = used
+		}
+		if used > s.windowLast {
+			s.windowLast = used
+		}
+		if remaining < s.Remaining {
+			s.Remaining = remaining
+		}
+	default:
+		// 並行リクエストの応答が前後して古い窓のものが届いた
+		return
+	}
+	s.Limit = limit
+	s.seen = true
+}
+
+func (s *rateStats) addCost(cost int) {
+	s.mu.Lock()
+	s.Cost += cost
+	s.mu.Unlock()
+}
+
+// 例: "API: 42 requests, ~57 points used (rateLimit.cost: 40), 4943/5000 remaining, resets at 2024-01-01T10:00:00Z"
+func (s *rateStats) summary() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cost := ""
+	if s.Cost > 0 {
+		cost = fmt.Sprintf(" (rateLimit.cost: %d)", s.Cost)
+	}
+	if !s.seen {
+		return fmt.Sprintf("API: %d requests%s (no rate-limit headers in the responses)", s.Requests, cost)
+	}
+	return fmt.Sprintf("API: %d requests, ~%d points used%s, %d/%d remaining, resets at %s",
+		s.Requests, s.used+s.windowLast-s.windowFirst, cost, s.Remaining, s.Limit, s.Reset.UTC().Format(time.RFC3339))
+}
+
+// --min-rate-remaining。0 なら先回りして待たない
+var minRateRemaining int
+
+// クエリの rateLimit.cost を記録し、remaining が minRateRemaining を下回ったら resetAt まで待つ。
+// 上限に当たってから 403 を待つより、並行ワーカーがまとめて失敗しにくい
+func throttleOnRateLimit(ctx context.Context, rl *gqlRateLimit) error {
+	if rl == nil {
+		return nil
+	}
+	apiStats.addCost(rl.Cost)
+	if minRateRemaining <= 0 || rl.Remaining >= minRateRemaining || rl.ResetAt.IsZero() {
+		return nil
+	}
+	wait := time.Until(rl.ResetAt) + time.Second
+	if wait <= 0 {
+		return nil
+	}
+	warnf("rate limit remaining %d < --min-rate-remaining %d; pausing %s until %s\n",
+		rl.Remaining, minRateRemaining, wait.Round(time.Second), rl.ResetAt.UTC().Format(time.RFC3339))
+	return sleepCtx(ctx, wait)
+}
+
+// doGraphQL が使う HTTP クライアント。テストでは httptest のサーバーに向けたものに差し替える
+type httpDoer interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+var httpClient httpDoer = &http.Client{Timeout: 30 * time.Second}
+
+// doGraphQL の再試行回数と待ち時間 (--retry-max / --retry-base-ms / --retry-max-delay)
+type backoff struct {
+	Attempts int
+	Base     time.Duration
+	Max      time.Duration
+}
+
+var retryBackoff = backoff{Attempts: 5, Base: 300 * time.Millisecond, Max: 30 * time.Second}
+
+// full jitter: [0, min(Max, Base*2^attempt)] の一様乱数。並行ワーカーの再試行がそろわないようにする
+func (b backoff) delay(attempt int) time.Duration {
+	ceil := b.Max
+	if attempt < 30 {
+		if d := b.Base << uint(attempt); d > 0 && d < ceil {
+			ceil = d
+		}
+	}
+	if ceil <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(ceil) + 1))
+}
+
+// ctx がキャンセルされたら待たずに ctx.Err() を返す
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// GHES は https://HOST/api/graphql
+func validateEndpoint(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return fmt.Errorf("%q: scheme must be http or https", raw)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("%q: missing host", raw)
+	}
+	return nil
+}
+
+func doGraphQL(ctx context.Context, endpoint, token string, q string, vars map[string]interface{}) ([]byte, error) {
+	body, _ := json.Marshal(graphQLRequest{Query: q, Variables: vars})
+	op := operationName(q)
+	if stderrLevel >= levelDebug {
+		// トークンはヘッダーにしか載せないので変数はそのまま出してよい
+		v, _ := json.Marshal(vars)
+		debugf("graphql %s vars=%s\n", op, v)
+	}
+	var cacheKey string
+	if gqlCache != nil {
+		cacheKey = gqlCache.key(endpoint, token, body)
+		if b, ok := gqlCache.get(cacheKey); ok {
+			debugf("graphql %s: cache hit (%d bytes)\n", op, len(b))
+			return b, nil
+		}
+	}
+
+	var lastErr error
+	for attempt := 0; attempt < retryBackoff.Attempts; attempt++ {
+		// Body は送信で消費されるので試行ごとに作り直す
+		req, _ := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Accept", "application/vnd.github+json")
+		req.Header.Set("Content-Type", "application/json")
+		start := time.Now()
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			debugf("graphql %s attempt %d: %v\n", op, attempt+1, err)
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			lastErr = err
+			if err := sleepCtx(ctx, retryBackoff.delay(attempt)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		// 再試行で接続を再利用できるよう、試行ごとにその場で閉じる (ループ内で defer しない)
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		apiStats.record(resp.Header)
+		debugf("graphql %s attempt %d: http %d, %d bytes in %s (rate limit remaining %s)\n",
+			op, attempt+1, resp.StatusCode, len(b), time.Since(start).Round(time.Millisecond), resp.Header.Get("X-RateLimit-Remaining"))
+		if wait, limited := rateLimitWait(resp.StatusCode, resp.Header, b); limited {
+			lastErr = fmt.Errorf("rate limited (http %d): %s", resp.StatusCode, string(b))
+			warnf("rate limited (http %d); waiting %s before retrying\n", resp.StatusCode, wait.Round(time.Second))
+			if err := sleepCtx(ctx, wait); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if retryStatuses.has(resp.StatusCode) {
+			lastErr = fmt.Errorf("http %d: %s", resp.StatusCode, string(b))
+			wait := retryBackoff.delay(attempt)
+			if d, ok := retryAfter(resp.Header); ok {
+				wait = d
+			}
+			if err := sleepCtx(ctx, wait); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if resp.StatusCode == 401 || resp.StatusCode == 403 {
+			return nil, fmt.Errorf("auth error %d (check the token and its scopes): %s", resp.StatusCode, string(b))
+		}
+		if gqlCache != nil && resp.StatusCode == http.StatusOK {
+			gqlCache.put(cacheKey, b)
+		}
+		return b, nil
+	}
+	return nil, lastErr
+}
+
+// login が org か user かを返す ("org" / "user")。どちらでもなければエラー
+func resolveOwnerType(ctx context.Context, endpoint, token, login string) (string, error) {
+	const q = `query OwnerType($login:String!) { repositoryOwner(login:$login) { __typename } }`
+	b, err := doGraphQL(ctx, endpoint, token, q, map[string]interface{}{"login": login})
+	if err != nil {
+		return "", err
+	}
+	var out ownerTypeResp
+	if err := json.Unmarshal(b, &out); err != nil {
+		return "", err
+	}
+	if len(out.Errors) > 0 {
+		return "", joinGQLErrors(out.Errors)
+	}
+	if out.Data.RepositoryOwner == nil {
+		return "", fmt.Errorf("%q is neither a user nor an organization", login)
+	}
+	switch out.Data.RepositoryOwner.Typename {
+	case "Organization":
+		return "org", nil
+	case "User":
+		return "user", nil
+	}
+	return "", fmt.Errorf("%q is a %s, not a user or an organization", login, out.Data.RepositoryOwner.Typename)
+}
+
+// visibility: all|public|private
+// myRepos: viewer が直接コラボレーターのリポジトリ (affiliations: COLLABORATOR) に限定
+func fetchOrgRepos(ctx context.Context, endpoint, token, org string, includeForks, includeArchived bool, visibility string, maxRepos int, myRepos bool) ([]repoInfo, error) {
+	return fetchOwnerRepos(ctx, endpoint, token, "organization", org, includeForks, includeArchived, visibility, maxRepos, myRepos)
+}
+
+// 個人アカウントのリポジトリ。user.repositories は既定でコラボレーターとして参加している他人のリポジトリも返すので、
+// 本人が所有するもの (ownerAffiliations: OWNER) に限る
+func fetchUserRepos(ctx context.Context, endpoint, token, login string, includeForks, includeArchived bool, visibility string, maxRepos int, myRepos bool) ([]repoInfo, error) {
+	return fetchOwnerRepos(ctx, endpoint, token, "user", login, includeForks, includeArchived, visibility, maxRepos, myRepos)
+}
+
+// ownerField: organization|user
+func fetchOwnerRepos(ctx context.Context, endpoint, token, ownerField, login string, includeForks, includeArchived bool, visibility string, maxRepos int, myRepos bool) ([]repoInfo, error) {
+	ownerArgs := ""
+	if ownerField == "user" {
+		ownerArgs = ",\n      ownerAffiliations:[OWNER]"
+	}
+	reposQuery := fmt.Sprintf(`
+query OwnerRepos($login:String!, $cursor:String, $privacy: RepositoryPrivacy, $affiliations: [RepositoryAffiliation]) {
+  owner: %s(login:$login) {
+    repositories(
+      first:100,
+      after:$cursor,
+      orderBy:{field: NAME, direction: ASC},
+      privacy:$privacy,
+      affiliations:$affiliations%s
+    ) {
       pageInfo { hasNextPage endCursor }
       nodes { name isFork isArchived isPrivate }
     }
   }
-}`
+  rateLimit { cost remaining resetAt }
+}`, ownerField, ownerArgs)
 	// privacy は単一値。all の場合は nil を渡す（未指定）。
 	var privacy *string
 	switch strings.ToLower(visibility) {
@@ -167,15 +1326,16 @@ query($org:String!, $cursor:String, $privacy: RepositoryPrivacy) {
 	case "", "all":
 		privacy = nil
 	default:
-		fmt.Fprintf(os.Stderr, "WARN: unknown visibility %q -> using all\n", visibility)
+		warnf("unknown visibility %q -> using all\n", visibility)
 		privacy = nil
 	}
 
-	var repos []string
+	var repos []repoInfo
 	var cursor *string
+	rateRetries := 0
 	for {
 		vars := map[string]interface{}{
-			"org": org,
+			"login": login,
 			"cursor": func() interface{} {
 				if cursor == nil {
 					return nil
@@ -188,8 +1348,14 @@ query($org:String!, $cursor:String, $privacy: RepositoryPrivacy) {
 				}
 				return *privacy
 			}(),
+			"affiliations": func() interface{} {
+				if !myRepos {
+					return nil
+				}
+				return []string{"COLLABORATOR"}
+			}(),
 		}
-		b, err := doGraphQL(token, reposQuery, vars)
+		b, err := doGraphQL(ctx, endpoint, token, reposQuery, vars)
 		if err != nil {
 			return nil, err
 		}
@@ -197,14 +1363,25 @@ query($org:String!, $cursor:String, $privacy: RepositoryPrivacy) {
 		if err := json.Unmarshal(b, &out); err != nil {
 			return nil, err
 		}
-		if len(out.Errors) > 0 {
-			msgs := make([]string, 0, len(out.Errors))
-			for _, e := range out.Errors {
-				msgs = append(msgs, e.Message)
+		if retry, err := waitGQLRateLimit(ctx, "listing repos of "+login, out.Errors, &rateRetries); err != nil {
+			return nil, err
+		} else if retry {
+			continue
+		}
+		rateRetries = 0
+		if err := throttleOnRateLimit(ctx, out.Data.RateLimit); err != nil {
+			return nil, err
+		}
+		if out.Data.Owner == nil {
+			if len(out.Errors) > 0 {
+				return nil, fmt.Errorf("no %s %q: %w", ownerField, login, joinGQLErrors(out.Errors))
 			}
-			return nil, errors.New(strings.Join(msgs, "; "))
+			return nil, fmt.Errorf("no %s %q", ownerField, login)
+		}
+		if len(out.Errors) > 0 {
+			return nil, joinGQLErrors(out.Errors)
 		}
-		nodes := out.Data.Organization.Repositories.Nodes
+		nodes := out.Data.Owner.Repositories.Nodes
 		for _, n := range nodes {
 			if !includeForks && n.IsFork {
 				continue
@@ -212,13 +1389,13 @@ query($org:String!, $cursor:String, $privacy: RepositoryPrivacy) {
 			if !includeArchived && n.IsArchived {
 				continue
 			}
-			repos = append(repos, n.Name)
+			repos = append(repos, n)
 			if maxRepos > 0 && len(repos) >= maxRepos {
 				return repos, nil
 			}
 		}
-		if out.Data.Organization.Repositories.PageInfo.HasNextPage {
-			next := out.Data.Organization.Repositories.PageInfo.EndCursor
+		if out.Data.Owner.Repositories.PageInfo.HasNextPage {
+			next := out.Data.Owner.Repositories.PageInfo.EndCursor
 			cursor = &next
 		} else {
 			break
@@ -227,38 +1404,273 @@ query($org:String!, $cursor:String, $privacy: RepositoryPrivacy) {
 	return repos, nil
 }
 
-func fetchRepoPRAgg(token, owner, repo string, branches []string, since, until time.Time, maxPerBranch int) (map[string]*agg, error) {
+// refs/heads/ を全ページ取得し、re に一致するブランチ名を返す
+func fetchRepoBranches(ctx context.Context, endpoint, token, owner, repo string, re *regexp.Regexp) ([]string, error) {
+	const refsQuery = `
+query RepoBranches($owner:String!, $name:String!, $cursor:String) {
+  repository(owner:$owner, name:$name) {
+    refs(refPrefix:"refs/heads/", first:100, after:$cursor) {
+      pageInfo { hasNextPage endCursor }
+      nodes { name }
+    }
+  }
+}`
+	var branches []string
+	var cursor interface{}
+	for {
+		vars := map[string]interface{}{"owner": owner, "name": repo, "cursor": cursor}
+		b, err := doGraphQL(ctx, endpoint, token, refsQuery, vars)
+		if err != nil {
+			return nil, err
+		}
+		var out refsResp
+		if err := json.Unmarshal(b, &out); err != nil {
+			return nil, err
+		}
+		if len(out.Errors) > 0 {
+			if hasNotFoundError(out.Errors) {
+				return nil, fmt.Errorf("%w: %v", errRepoNotFound, joinGQLErrors(out.Errors))
+			}
+			return nil, joinGQLErrors(out.Errors)
+		}
+		refs := out.Data.Repository.Refs
+		for _, n := range refs.Nodes {
+			if re.MatchString(n.Name) {
+				branches = append(branches, n.Name)
+			}
+		}
+		if !refs.PageInfo.HasNextPage {
+			break
+		}
+		cursor = refs.PageInfo.EndCursor
+	}
+	return branches, nil
+}
+
+// prNode に対応するフィールド。$threads / $files / $labels / $reviews は利用側のクエリで宣言する
+const prFieldsFragment = `
+fragment prFields on PullRequest {
+  number
+  state
+  mergedAt
+  createdAt
+  updatedAt
+  additions
+  deletions
+  changedFiles
+  baseRefName
+  author { login }
+  mergedBy { login }
+  milestone { title }
+  authorAssociation
+  reviewDecision
+  reviewThreads(first: 100) @include(if: $threads) { nodes { isResolved } }
+  files(first: 100) @include(if: $files) { nodes { path additions deletions } }
+  labels(first: 20) @include(if: $labels) { nodes { name } }
+  reviews(first: 50) @include(if: $reviews) { nodes { author { login } state } }
+}`
+
+// フィルタを通った PR を著者ごとの集計に足す。--explain の判定ログもここで出す
+func accumulatePR(totals map[string]*agg, owner, repo string, n prNode, filter prFilter, generated generatedRules) {
+	// --path-prefix / --include-paths / --exclude-paths では一致するファイルだけで数え直す (changedFiles も一致した件数にする)
+	byPath := filter.filtersPaths()
+	if byPath {
+		n.Additions, n.Deletions, n.ChangedFiles = 0, 0, 0
+	}
+	if n.Files != nil {
+		for _, f := range n.Files.Nodes {
+			switch {
+			case byPath && !filter.matchesPath(f.Path):
+			case byPath:
+				n.ChangedFiles++
+				if !generated.isGenerated(f.Path) {
+					n.Additions += f.Additions
+					n.Deletions += f.Deletions
+				}
+			case generated.isGenerated(f.Path):
+				n.Additions -= f.Additions
+				n.Deletions -= f.Deletions
+			}
+		}
+	}
+	reason, detail := filter.skipReason(n)
+	if reason == "skipped-by-bot" {
+		botPRsExcluded.Add(1)
+	}
+	// 行数 0 の PR は --min-lines で落としても empty_prs には数える
+	empty := n.Additions == 0 && n.Deletions == 0
+	if reason != "" && !(reason == "skipped-by-size" && empty && filter.CountDroppedEmpty) {
+		explainPR(owner, repo, n, reason, detail)
+		return
+	}
+	login := filter.loginOf(n)
+	a := totals[login]
+	if a == nil {
+		a = &agg{}
+		totals[login] = a
+	}
+	if empty {
+		a.EmptyPRs++
+	}
+	if reason != "" {
+		explainPR(owner, repo, n, reason, detail)
+		return
+	}
+	explainPR(owner, repo, n, "counted", "")
+	a.add(n)
+	if filter.KeepRaw {
+		a.Raw = append(a.Raw, n)
+	}
+	if filter.Period != "" {
+		if a.Periods == nil {
+			a.Periods = map[string]*agg{}
+		}
+		p := periodOf(filter.dateOf(n), filter.Period)
+		sub := a.Periods[p]
+		if sub == nil {
+			sub = &agg{}
+			a.Periods[p] = sub
+		}
+		sub.add(n)
+	}
+	if filter.IncludeReviews {
+		addReviews(totals, n, filter)
+	}
+}
+
+// PR のレビューをレビュアーごとに数える。同じ人の同じ state は1回、PR 作成者自身のものは数えない。
+// 作成者に対する --authors / --exclude-bots はレビュアーにも適用する
+func addReviews(totals map[string]*agg, n prNode, filter prFilter) {
+	if n.Reviews == nil {
+		return
+	}
+	seen := map[[2]string]bool{}
+	for _, r := range n.Reviews.Nodes {
+		switch r.State {
+		case "APPROVED", "CHANGES_REQUESTED", "COMMENTED":
+		default:
+			continue
+		}
+		var login string
+		switch {
+		case r.Author == nil:
+			login = ghostLogin
+		case r.Author.Login == "":
+			login = unknownLogin
+		default:
+			login = r.Author.Login
+			if login == n.authorLogin() {
+				continue
+			}
+			if filter.Bots != nil && (strings.HasSuffix(login, "[bot]") || filter.Bots.MatchString(login)) {
+				continue
+			}
+			if len(filter.Authors) > 0 && !filter.Authors[strings.ToLower(login)] {
+				continue
+			}
+		}
+		if filter.DropUnknownAuthors && (login == ghostLogin || login == unknownLogin) {
+			continue
+		}
+		key := [2]string{login, r.State}
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		a := totals[login]
+		if a == nil {
+			a = &agg{}
+			totals[login] = a
+		}
+		if a.Reviews == nil {
+			a.Reviews = map[string]int{}
+		}
+		a.Reviews[r.State]++
+		if filter.Period != "" {
+			if a.Periods == nil {
+				a.Periods = map[string]*agg{}
+			}
+			p := periodOf(filter.dateOf(n), filter.Period)
+			sub := a.Periods[p]
+			if sub == nil {
+				sub = &agg{}
+				a.Periods[p] = sub
+			}
+			if sub.Reviews == nil {
+				sub.Reviews = map[string]int{}
+			}
+			sub.Reviews[r.State]++
+		}
+	}
+}
+
+// --bucket の期間ラベル (reportLoc)。month: 2024-01 / week: ISO 週 2024-W05 / day: 2024-01-31
+func periodOf(t time.Time, bucket string) string {
+	t = t.In(reportLoc)
+	switch bucket {
+	case "month":
+		return t.Format("2006-01")
+	case "week":
+		y, w := t.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", y, w)
+	}
+	return t.Format("2006-01-02")
+}
+
+// branchConcurrency: ベースブランチを同時に何本取得するか (1 で直列)
+func fetchRepoPRAgg(ctx context.Context, endpoint, token, owner, repo string, branches []string, filter prFilter, maxPerBranch, branchConcurrency int) (map[string]*agg, error) {
 	const prQuery = `
-query($owner:String!, $name:String!, $base:String!, $cursor:String) {
+query RepoPullRequests($owner:String!, $name:String!, $base:String, $cursor:String, $first:Int!, $threads:Boolean!, $files:Boolean!, $labels:Boolean!, $reviews:Boolean!, $states:[PullRequestState!]) {
   repository(owner:$owner, name:$name) {
     pullRequests(
-      first: 100
+      first: $first
       after: $cursor
-      states: MERGED
+      states: $states
       orderBy: { field: UPDATED_AT, direction: DESC }
       baseRefName: $base
     ) {
       pageInfo { hasNextPage endCursor }
-      nodes {
-        number
-        mergedAt
-        additions
-        deletions
-        baseRefName
-        author { login }
-      }
+      nodes { ...prFields }
     }
   }
-}`
+  rateLimit { cost remaining resetAt }
+}` + prFieldsFragment
+	// branches が nil なら baseRefName を指定せず全ブランチの PR を一度に取得する
+	if branches == nil {
+		branches = []string{""}
+	}
+	var generated generatedRules
+	if filter.RespectGitattributes {
+		text, err := fetchGitattributes(ctx, endpoint, token, owner, repo)
+		if err != nil {
+			return nil, err
+		}
+		generated = parseGitattributes(text)
+	}
 	totals := map[string]*agg{}
-	for _, base := range branches {
+	seen := map[int]bool{} // filter.Dedupe 用。PR番号で重複排除
+	var mu sync.Mutex      // totals / seen を保護（ブランチ並列時）
+	scanBranch := func(base string) error {
 		var cursor *string
 		scanned := 0
+		pageSize := 100
+		timeoutRetries, rateRetries := 0, 0
 		for {
 			vars := map[string]interface{}{
-				"owner": owner,
-				"name":  repo,
-				"base":  base,
+				"owner":   owner,
+				"name":    repo,
+				"first":   pageSize,
+				"threads": filter.RequireResolvedThreads,
+				"files":   filter.needsFiles(),
+				"labels":  filter.needsLabels(),
+				"reviews": filter.IncludeReviews,
+				"states":  filter.states(),
+				"base": func() interface{} {
+					if base == "" {
+						return nil
+					}
+					return base
+				}(),
 				"cursor": func() interface{} {
 					if cursor == nil {
 						return nil
@@ -266,46 +1678,64 @@ query($owner:String!, $name:String!, $base:String!, $cursor:String) {
 					return *cursor
 				}(),
 			}
-			b, err := doGraphQL(token, prQuery, vars)
+			b, err := doGraphQL(ctx, endpoint, token, prQuery, vars)
 			if err != nil {
-				return nil, fmt.Errorf("repo %s/%s base %s: %w", owner, repo, base, err)
+				label := base
+				if label == "" {
+					label = "(all)"
+				}
+				return fmt.Errorf("repo %s/%s base %s: %w", owner, repo, label, err)
 			}
 			var out prResp
 			if err := json.Unmarshal(b, &out); err != nil {
-				return nil, err
+				return err
+			}
+			if err := throttleOnRateLimit(ctx, out.Data.RateLimit); err != nil {
+				return err
 			}
 			if len(out.Errors) > 0 {
-				msgs := make([]string, 0, len(out.Errors))
-				for _, e := range out.Errors {
-					msgs = append(msgs, e.Message)
+				if retry, err := waitGQLRateLimit(ctx, owner+"/"+repo, out.Errors, &rateRetries); err != nil {
+					return err
+				} else if retry {
+					continue
+				}
+				// TIMEOUT はページサイズを半分にして同じカーソルから取り直す
+				if hasTimeoutError(out.Errors) && timeoutRetries < 3 && pageSize > 1 {
+					timeoutRetries++
+					pageSize /= 2
+					warnf("%s/%s: GraphQL TIMEOUT, retrying with page size %d\n", owner, repo, pageSize)
+					continue
 				}
-				return nil, errors.New(strings.Join(msgs, "; "))
+				if hasForbiddenError(out.Errors) {
+					return fmt.Errorf("%w: %v", errNoPRAccess, joinGQLErrors(out.Errors))
+				}
+				if hasNotFoundError(out.Errors) {
+					return fmt.Errorf("%w: %v", errRepoNotFound, joinGQLErrors(out.Errors))
+				}
+				return joinGQLErrors(out.Errors)
 			}
+			timeoutRetries, rateRetries = 0, 0
 
 			nodes := out.Data.Repository.PullRequests.Nodes
 			if len(nodes) == 0 {
 				break
 			}
+			mu.Lock()
 			for _, n := range nodes {
 				scanned++
-				if inRange(n.MergedAt, since, until) {
-					login := n.Author.Login
-					if login == "" {
-						login = "(unknown)"
+				if filter.Dedupe {
+					if seen[n.Number] {
+						explainPR(owner, repo, n, "skipped-by-dedupe", "")
+						continue
 					}
-					a := totals[login]
-					if a == nil {
-						a = &agg{}
-						totals[login] = a
-					}
-					a.Additions += n.Additions
-					a.Deletions += n.Deletions
-					a.PRs += 1
+					seen[n.Number] = true
 				}
+				accumulatePR(totals, owner, repo, n, filter, generated)
 				if scanned >= maxPerBranch {
 					break
 				}
 			}
+			mu.Unlock()
 			if scanned >= maxPerBranch {
 				break
 			}
@@ -316,143 +1746,1199 @@ query($owner:String!, $name:String!, $base:String!, $cursor:String) {
 				break
 			}
 		}
+		return nil
+	}
+
+	if branchConcurrency <= 1 || len(branches) == 1 {
+		for _, base := range branches {
+			if err := scanBranch(base); err != nil {
+				return nil, err
+			}
+		}
+		return totals, nil
+	}
+
+	// ブランチごとのクエリは独立なので上限付きで並列に取得する
+	sem := make(chan struct{}, branchConcurrency)
+	errs := make([]error, len(branches))
+	var wg sync.WaitGroup
+	for i, base := range branches {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, base string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			errs[i] = scanBranch(base)
+		}(i, base)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
 	}
 	return totals, nil
 }
 
 func main() {
 	var (
-		org             = flag.String("org", "", "GitHub organization login (required)")
+		configPath      = flag.String("config", "", "JSON file of flag values keyed by flag name (e.g. {\"org\": \"your-org\", \"concurrency\": 8}); command-line flags take precedence")
+		org             = flag.String("org", "", "GitHub organization (or user, see --owner-type) login, or a comma-separated list of them (required)")
+		ownerType       = flag.String("owner-type", "org", "Kind of the --org logins: org | user (personal account) | auto (look up each login; one extra query per login)")
+		endpoint        = flag.String("endpoint", "", "GraphQL API URL (default $GITHUB_GRAPHQL_URL or "+defaultEndpoint+"; GHES: https://HOST/api/graphql)")
 		branchesRE      = flag.String("branches", "^(master|main|develop|staging|testing)$", "Regex of base branches to include")
+		branchSource    = flag.String("branch-source", "remote", "Where --branches is matched: remote (each repo's refs/heads, one extra query per repo) | candidates (fixed list master/main/develop/staging/testing)")
 		sinceStr        = flag.String("since", "", "Include PRs merged at or after this time (RFC3339 or 2006-01-02)")
-		untilStr        = flag.String("until", "", "Include PRs merged at or before this time (RFC3339 or 2006-01-02)")
+		untilStr        = flag.String("until", "", "Include PRs merged at or before this time (RFC3339, or 2006-01-02 for the whole day)")
+		sinceDays       = flag.Int("since-days", 0, "Relative --since: N days before now (ignored when --since is given)")
+		untilDays       = flag.Int("until-days", 0, "Relative --until: N days before now (ignored when --until is given)")
+		singleRepo      = flag.String("repo", "", "Scan only this repository of --org (skips listing org repos)")
+		allBranches     = flag.Bool("all-branches", false, "Fetch merged PRs to any base branch in one pass (ignores --branches)")
+		dedupe          = flag.Bool("dedupe", false, "Count each PR number at most once per repo")
+		project         = flag.Int("project", 0, "Aggregate merged PRs on this org ProjectV2 (project number) across all repos instead of scanning repos")
+		reposFile       = flag.String("repos-file", "", "Scan exactly the repo names listed in this file (one per line) instead of listing the org")
+		reposList       = flag.String("repos", "", "Scan exactly these comma-separated repo names (or org/name) instead of listing the org")
+		excludeRepos    = flag.String("exclude-repos", "", "Comma-separated repo names (or org/name) to leave out before any PR query")
+		excludeReposRE  = flag.String("exclude-repos-regex", "", "Regex of repo names to leave out before any PR query")
+		dumpRepos       = flag.String("dump-repos", "", "Write the resolved repo list to this file (reusable with --repos-file)")
+		myRepos         = flag.Bool("my-repos", false, "Only scan org repos the token's user was added to as a collaborator")
+		branchConc      = flag.Int("branch-concurrency", 1, "Fetch up to N base branches of a repo concurrently (1 = serial)")
+		tokenFile       = flag.String("token-file", "", "Read the token from this file instead of the environment (takes precedence over GITHUB_ACCESS_TOKEN / GITHUB_TOKEN / GH_TOKEN)")
+		continueOnError = flag.Bool("continue-on-error", false, "Log a repo that fails and keep scanning the rest instead of exiting (exit 1 only if every repo fails)")
+		concurrency     = flag.Int("concurrency", 4, "Scan up to N repositories concurrently (1 = serial)")
+		timeout         = flag.Duration("timeout", 0, "Overall deadline for the run's API calls (e.g. 30m); on expiry the rows collected so far are written (0 = none)")
 		includeForks    = flag.Bool("include-forks", false, "Include forked repositories")
 		includeArchived = flag.Bool("include-archived", false, "Include archived repositories")
 		visibility      = flag.String("visibility", "all", "Repository visibility: all|public|private (mapped to privacy)")
 		maxRepos        = flag.Int("max-repos", 0, "Safety cap: stop after scanning N repos (0 = no cap)")
 		maxPerBr        = flag.Int("max-per-branch", 1000, "Safety cap: max PRs to scan per branch per repo")
 		out             = flag.String("out", "", "Write CSV to file (default stdout)")
+		format          = flag.String("format", "csv", "Output format: csv|json|ndjson|markdown|html|treemap-json|openmetrics")
+		rawOut          = flag.String("raw-out", "", "Also write every counted PR as one CSV row to this file")
+		stream          = flag.Bool("stream", false, "Write each repo's rows (csv/ndjson) as soon as that repo finishes, sorted within the repo only, instead of one globally sorted output")
+		maxRowsPerFile  = flag.Int("max-rows-per-file", 0, "With --out and csv, split output into numbered files (out-1.csv, out-2.csv, ...) of at most N rows each")
+		sqliteOut       = flag.String("sqlite-out", "", "Append the result rows to table pr_stats in this SQLite database (created if missing)")
+		heatmapOut      = flag.String("heatmap", "", "Write per-author daily touched lines (author -> date -> lines) as JSON to this file")
+		quiet           = flag.Bool("quiet", false, "Only print ERROR messages to stderr (no WARN lines, summary or counts); same as --log-level error")
+		logLevelFlag    = flag.String("log-level", "info", "stderr verbosity: error | warn | info | debug (debug logs every GraphQL request)")
+		repoSummary     = flag.Int("repo-summary", 0, "Also print the top N repos by touched lines (additions, deletions, PRs) to stderr (0 = off)")
+		topN            = flag.Int("top-n", 10, "Number of contributors in the stderr summary (0 = no summary)")
+		totalsOut       = flag.String("totals-out", "", "Also write every author's org-wide totals (org,user,additions,deletions,prs,score) to this CSV, highest score first")
+		repoActivity    = flag.String("repo-activity", "", "Write a per-repo CSV (repo,last_merged_at,total_prs) to this file, stalest first")
+		tee             = flag.Bool("tee", false, "With --out, also write the output to stdout")
+		withNet         = flag.Bool("with-net", false, "Add a net column (additions - deletions, can be negative) after deletions")
+		withScore       = flag.Bool("with-score", true, "Include the score column (additions + |deletions|, the default sort key); --with-score=false drops it")
+		milestone       = flag.String("milestone", "", "Only count PRs whose milestone title matches (case-insensitive)")
+		withConsistency = flag.Bool("with-consistency", false, "Add active_weeks and consistency columns (weeks with a merge / weeks in the window)")
+		withLeadTime    = flag.Bool("with-lead-time", false, "Add avg_lead_time_hours and median_lead_time_hours columns (createdAt -> mergedAt)")
+		includeLabels   = flag.String("include-labels", "", "Only count PRs with at least one of these comma-separated labels (case-insensitive)")
+		excludeLabels   = flag.String("exclude-labels", "", "Skip PRs with any of these comma-separated labels (case-insensitive)")
+		minLines        = flag.Int("min-lines", 0, "Skip PRs whose touched lines (additions + |deletions|) are below N")
+		withEmptyPRs    = flag.Bool("with-empty-prs", false, "Add an empty_prs column: PRs with 0 additions and 0 deletions (counted even when --min-lines drops them)")
+		withFiles       = flag.Bool("with-files", false, "Add a files column (sum of changedFiles) and show average files per PR in the stderr summary")
+		withPRSize      = flag.Bool("with-pr-size", false, "Add median_pr_size, p90_pr_size and max_pr_size columns (per-PR touched lines)")
+		withWeekend     = flag.Bool("with-weekend-split", false, "Add weekday_prs and weekend_prs columns (by merge time)")
+		includeReviews  = flag.Bool("include-reviews", false, "Count reviews per reviewer login (approved_reviews/changes_requested_reviews/commented_reviews columns; first 50 reviews per PR)")
+		withDecision    = flag.Bool("with-review-decision", false, "Add per-author counts of PRs by reviewDecision (approved/changes_requested/review_required/none)")
+		withDates       = flag.Bool("with-dates", false, "Add first_merged and last_merged (RFC3339) to rows and to the org-totals summary")
+		excludeBots     = flag.Bool("exclude-bots", false, "Skip PRs by bot authors: logins ending in [bot] or matching --bot-pattern")
+		botPattern      = flag.String("bot-pattern", `(\[bot\]$|^dependabot|^renovate)`, "Regex of author logins treated as bots by --exclude-bots")
+		bucket          = flag.String("bucket", "", "Split each author's rows by merge period (in --timezone): month | week (ISO week) | day; adds a period column")
+		timezone        = flag.String("timezone", "UTC", "IANA time zone (e.g. Asia/Tokyo) for date-only --since/--until, --bucket periods and day/week/weekday stats")
+		statesFlag      = flag.String("states", "MERGED", "Comma-separated PR states to fetch: MERGED, CLOSED (closed without merging), OPEN")
+		dateField       = flag.String("date-field", "merged", "Timestamp --since/--until and --bucket use: merged | created | updated")
+		groupBy         = flag.String("group-by", "author", "Login each PR is aggregated under: author | merger (the user who merged it) | team (the author's team in --identity-map)")
+		byTeamFlag      = flag.Bool("by-team", false, "Output one row per org team (from the org's GitHub teams; needs read:org) instead of per repo and author")
+		teamPriority    = flag.String("team-priority", "", "With --by-team, count each author toward only the first of these comma-separated team slugs they belong to (default: every team)")
+		dropUnknown     = flag.Bool("drop-unknown-authors", false, "Skip PRs (and reviews) whose login is unavailable instead of counting them as (ghost) / (unknown)")
+		identityMapPath = flag.String("identity-map", "", "CSV (login,name[,team]) or .json file mapping logins to display names and teams; adds name/team columns")
+		authors         = flag.String("authors", "", "Only count PRs authored by these comma-separated logins (case-insensitive)")
+		associations    = flag.String("author-association", "", "Only count PRs whose authorAssociation is in this comma-separated list (e.g. MEMBER,OWNER)")
+		requireResolved = flag.Bool("require-resolved-threads", false, "Only count PRs whose review threads are all resolved (fetches review threads)")
+		pathPrefix      = flag.String("path-prefix", "", "Only count lines in files whose path starts with this prefix (e.g. services/payments/); PRs touching none are skipped. Fetches per-file stats (first 100 files per PR)")
+		includePaths    = flag.String("include-paths", "", "Only count lines in files matching any of these comma-separated globs (e.g. '**/*.go'; '**' spans directories)")
+		excludePaths    = flag.String("exclude-paths", "", "Don't count lines in files matching any of these comma-separated globs (e.g. '*_test.go')")
+		respectAttrs    = flag.Bool("respect-gitattributes", false, "Subtract lines of files marked linguist-generated in each repo's .gitattributes (fetches per-file stats; expensive)")
+		withMilestone   = flag.Bool("with-milestone", false, "Add a milestone column listing the milestones of counted PRs")
+		uploadCmd       = flag.String("upload-cmd", "", "Shell command run after the output is written; {path} is replaced with the --out path and the file is piped to stdin")
+		topPerRepo      = flag.Int("top-per-repo", 0, "Keep only the top K contributors by score per repo (per repo and period with --bucket) in the row output (0 = all; org totals are unaffected)")
+		repoGroupRE     = flag.String("repo-group-regex", "", "Regex with a capture group; the first group matched against the repo name is written to a repo_group column")
+		explain         = flag.Bool("explain", false, "Log to stderr, per PR, whether it was counted or why it was skipped (best with --repo)")
+		withGrandTotal  = flag.Bool("with-grand-total", false, "Append a final CSV row with repo=TOTAL, user=ALL summing all PRs")
+		progress        = flag.Bool("progress", false, "Print a line to stderr as each repo starts, with a running count of counted PRs")
+		dryRun          = flag.Bool("dry-run", false, "Print the resolved repo list with fork/archived/private flags to stdout and exit without scanning PRs")
+		estimateCost    = flag.Bool("estimate-cost", false, "Print an estimate of GraphQL requests/points before scanning and ask for confirmation")
+		assumeYes       = flag.Bool("yes", false, "With --estimate-cost, proceed without prompting")
+		withProvenance  = flag.Bool("with-provenance-footer", false, "Append '#'-prefixed lines with org, window, tool version and generation time to the CSV")
+		mergeByEmail    = flag.Bool("merge-by-email", false, "Merge logins that share the same public profile email (best-effort; one extra request per author)")
+		alertThreshold  = flag.Int("alert-threshold", 0, "Exit with status 3 if a monitored author's touched lines exceed N (0 = off)")
+		minPRs          = flag.Int("min-prs", 0, "Drop authors whose org-wide PR count (all scanned repos) is below N from every output and the summary; review-only rows from --include-reviews are kept (0 = off)")
+		failIfEmpty     = flag.Bool("fail-if-empty", false, "Exit with status 5 when the output has no contributor rows (default: warn and exit 0)")
+		minTotalPRs     = flag.Int("min-total-prs", 0, "Exit with status 5 when fewer than N PRs were counted across all repos (0 = off)")
+		alertAuthors    = flag.String("alert-authors", "", "Comma-separated logins monitored by --alert-threshold (default: everyone)")
+		repoHealth      = flag.Bool("repo-health", false, "Print per-repo additions/deletions ratio to stderr (growing / balanced / shrinking)")
+		shutdownGrace   = flag.Duration("shutdown-grace", 30*time.Second, "On SIGINT/SIGTERM, how long to let the in-flight repo finish before writing partial output")
+		retryMax        = flag.Int("retry-max", 5, "Max attempts per GraphQL request (network errors, --retry-statuses and rate limits)")
+		retryBaseMs     = flag.Int("retry-base-ms", 300, "Base backoff in ms; attempt n waits a random time up to base*2^n (full jitter)")
+		minRateRemain   = flag.Int("min-rate-remaining", 0, "Pause until the rate limit resets when a query reports fewer remaining points than N (0 = only react to 403/429)")
+		cacheDir        = flag.String("cache-dir", "", "Development aid: cache GraphQL responses in this directory and reuse them instead of calling the API (results may be stale)")
+		cacheTTL        = flag.Duration("cache-ttl", time.Hour, "How long a --cache-dir entry is reused (0 = never expires)")
+		retryMaxDelay   = flag.Duration("retry-max-delay", 30*time.Second, "Upper bound of a single backoff wait (Retry-After / rate-limit resets are honored as-is)")
+		retryStatusSpec = flag.String("retry-statuses", "429,500-599", "HTTP statuses to retry: comma-separated codes and ranges (Retry-After is honored)")
+		expectedFile    = flag.String("expected-authors-file", "", "File of expected contributor logins (one per line); prints who had no activity and who was active but unexpected")
+		percentileRanks = flag.Bool("percentile-ranks", false, "Add additions_pctl/deletions_pctl/score_pctl columns: the author's percentile among org totals")
+		percentileOnly  = flag.Bool("percentile-only", false, "Like --percentile-ranks but omit the raw additions/deletions/net/score columns")
+		scoreModeFlag   = flag.String("score-mode", "touched", "How score is computed: touched (additions + |deletions|) | sum (additions + deletions as reported) | additions | net (additions - deletions)")
+		scoreBucket     = flag.Int("score-bucket", 0, "Round each score down to a multiple of N before sorting and output (0 = exact)")
+		transformCmd    = flag.String("transform-cmd", "", "Shell command that receives all rows as a JSON array on stdin and prints the transformed array on stdout")
+		sortBy          = flag.String("sort-by", "score,user,org,repo", "Comma-separated sort keys (score|additions|deletions|prs|org|repo|user|period), each optionally suffixed with :asc or :desc")
 	)
 	flag.Parse()
 
-	if *org == "" {
-		fmt.Fprintln(os.Stderr, "ERROR: --org is required")
-		os.Exit(1)
+	// SIGINT/SIGTERM は起動直後から受け取る。走査の前 (一覧・チームの取得、見積もり) は書き出すものがないので
+	// その場で中断の終了コードで終わり、走査が始まったら下の scan ループが受け取る
+	sigCh := make(chan os.Signal, 2)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	scanStarted := make(chan struct{})
+	go func() {
+		select {
+		case sig := <-sigCh:
+			warnf("received %s before scanning started; exiting without output\n", sig)
+			os.Exit(exitInterrupted)
+		case <-scanStarted:
+		}
+	}()
+
+	var unknownConfigKeys []string
+	if *configPath != "" {
+		cfg, err := loadConfig(*configPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR reading --config: %v\n", err)
+			os.Exit(1)
+		}
+		unknownConfigKeys, err = cfg.apply(flag.CommandLine)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR in --config: %v\n", err)
+			os.Exit(1)
+		}
 	}
 
-	token := os.Getenv("GITHUB_ACCESS_TOKEN")
-	if token == "" {
-		fmt.Fprintln(os.Stderr, "ERROR: set GITHUB_ACCESS_TOKEN env var with a PAT that can read the org repos")
+	level, err := parseLogLevel(*logLevelFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: invalid --log-level: %v\n", err)
 		os.Exit(1)
 	}
-
-	re := regexp.MustCompile(*branchesRE)
-	// よく使うブランチ名から正規表現で抽出（必要なら拡張）
-	candidates := []string{"master", "main", "develop", "staging", "testing"}
-	var branches []string
-	for _, b := range candidates {
-		if re.MatchString(b) {
-			branches = append(branches, b)
-		}
+	stderrLevel = level
+	if *quiet {
+		stderrLevel = levelError
 	}
-	if len(branches) == 0 {
-		fmt.Fprintln(os.Stderr, "WARN: no branches match regex; nothing to do")
-		return
+	for _, key := range unknownConfigKeys {
+		warnf("--config: unknown key %q ignored\n", key)
 	}
 
-	since := mustParseTimeOrZero(*sinceStr)
-	until := mustParseTimeOrZero(*untilStr)
+	orgs := splitList(*org)
+	if len(orgs) == 0 {
+		fmt.Fprintln(os.Stderr, "ERROR: --org is required")
+		os.Exit(1)
+	}
 
-	// 1) org内の全repo取得
-	repos, err := fetchOrgRepos(token, *org, *includeForks, *includeArchived, *visibility, *maxRepos)
+	loc, err := time.LoadLocation(*timezone)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "ERROR fetching repos: %v\n", err)
+		fmt.Fprintf(os.Stderr, "ERROR: invalid --timezone: %v\n", err)
 		os.Exit(1)
 	}
-	if len(repos) == 0 {
-		fmt.Fprintln(os.Stderr, "WARN: no repositories to scan")
-		return
-	}
+	reportLoc = loc
 
-	// 2) 各repoでPR集計 → org/author累計
-	type row struct {
-		Org       string
-		Repo      string
-		User      string
-		Additions int
-		Deletions int
-		PRs       int
-		Score     int
+	// --since-days / --until-days は実行時刻からの相対指定。--since / --until があればそちらを使う
+	if *sinceDays < 0 || *untilDays < 0 {
+		fmt.Fprintln(os.Stderr, "ERROR: --since-days and --until-days must be >= 0")
+		os.Exit(1)
+	}
+	now := time.Now().UTC()
+	if *sinceDays > 0 {
+		if *sinceStr != "" {
+			warnf("both --since and --since-days given; using --since %s\n", *sinceStr)
+		} else {
+			*sinceStr = now.AddDate(0, 0, -*sinceDays).Format(time.RFC3339)
+		}
+	}
+	if *untilDays > 0 {
+		if *untilStr != "" {
+			warnf("both --until and --until-days given; using --until %s\n", *untilStr)
+		} else {
+			*untilStr = now.AddDate(0, 0, -*untilDays).Format(time.RFC3339)
+		}
+	}
+
+	switch *format {
+	case "csv", "json", "ndjson", "markdown", "html", "treemap-json", "openmetrics":
+	default:
+		fmt.Fprintf(os.Stderr, "ERROR: unknown --format %q (csv|json|ndjson|markdown|html|treemap-json|openmetrics)\n", *format)
+		os.Exit(1)
+	}
+
+	if *endpoint == "" {
+		*endpoint = os.Getenv("GITHUB_GRAPHQL_URL")
+	}
+	if *endpoint == "" {
+		*endpoint = defaultEndpoint
+	}
+	if err := validateEndpoint(*endpoint); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: invalid --endpoint: %v\n", err)
+		os.Exit(1)
+	}
+
+	if *project > 0 && (*singleRepo != "" || *reposFile != "") {
+		fmt.Fprintln(os.Stderr, "ERROR: --project cannot be combined with --repo or --repos-file")
+		os.Exit(1)
+	}
+	switch *bucket {
+	case "", "month", "week", "day":
+	default:
+		fmt.Fprintf(os.Stderr, "ERROR: unknown --bucket %q (month|week|day)\n", *bucket)
+		os.Exit(1)
+	}
+	switch *groupBy {
+	case "author", "merger", "team":
+	default:
+		fmt.Fprintf(os.Stderr, "ERROR: unknown --group-by %q (author|merger|team)\n", *groupBy)
+		os.Exit(1)
+	}
+	var idMap *identityMap
+	if *identityMapPath != "" {
+		idMap, err = loadIdentityMap(*identityMapPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR reading --identity-map: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if *byTeamFlag {
+		for name, set := range map[string]bool{
+			"--group-by team":    *groupBy == "team",
+			"--identity-map":     idMap != nil,
+			"--stream":           *stream,
+			"--percentile-ranks": *percentileRanks || *percentileOnly,
+			// チームの行は repo / user が空なので、repo と user を前提にする出力とは併用できない
+			"--transform-cmd":       *transformCmd != "",
+			"--format treemap-json": *format == "treemap-json",
+			"--sqlite-out":          *sqliteOut != "",
+			"--top-per-repo":        *topPerRepo > 0,
+		} {
+			if set {
+				fmt.Fprintf(os.Stderr, "ERROR: --by-team cannot be combined with %s\n", name)
+				os.Exit(1)
+			}
+		}
+	} else if *teamPriority != "" {
+		warnf("--team-priority has no effect without --by-team\n")
+	}
+	if *groupBy == "team" {
+		if idMap == nil || !idMap.hasTeams {
+			fmt.Fprintln(os.Stderr, "ERROR: --group-by team requires an --identity-map with a team column")
+			os.Exit(1)
+		}
+		if *mergeByEmail {
+			fmt.Fprintln(os.Stderr, "ERROR: --group-by team cannot be combined with --merge-by-email")
+			os.Exit(1)
+		}
+	}
+	switch *ownerType {
+	case "org", "user", "auto":
+	default:
+		fmt.Fprintf(os.Stderr, "ERROR: unknown --owner-type %q (org|user|auto)\n", *ownerType)
+		os.Exit(1)
+	}
+	if *dryRun && *project > 0 {
+		fmt.Fprintln(os.Stderr, "ERROR: --dry-run cannot be combined with --project (resolving a project already reads its PRs)")
+		os.Exit(1)
+	}
+	if *project > 0 && *ownerType == "user" {
+		fmt.Fprintln(os.Stderr, "ERROR: --project supports organization projects only (--owner-type org)")
+		os.Exit(1)
+	}
+	if len(orgs) > 1 && (*project > 0 || *singleRepo != "") {
+		fmt.Fprintln(os.Stderr, "ERROR: --project and --repo need a single --org (use --repos-file with org/name lines instead)")
+		os.Exit(1)
+	}
+	if *concurrency < 1 {
+		fmt.Fprintln(os.Stderr, "ERROR: --concurrency must be >= 1")
+		os.Exit(1)
+	}
+	if *singleRepo != "" && *reposFile != "" {
+		fmt.Fprintln(os.Stderr, "ERROR: --repo and --repos-file are mutually exclusive")
+		os.Exit(1)
+	}
+	if *reposList != "" && (*singleRepo != "" || *reposFile != "" || *project > 0) {
+		fmt.Fprintln(os.Stderr, "ERROR: --repos cannot be combined with --repo, --repos-file or --project")
+		os.Exit(1)
+	}
+	if *reposList != "" && (*excludeRepos != "" || *excludeReposRE != "") {
+		fmt.Fprintln(os.Stderr, "ERROR: --repos and --exclude-repos / --exclude-repos-regex are mutually exclusive (just leave the repo out of --repos)")
+		os.Exit(1)
+	}
+	if *maxRowsPerFile > 0 && (*out == "" || *format != "csv") {
+		fmt.Fprintln(os.Stderr, "ERROR: --max-rows-per-file requires --out and --format csv")
+		os.Exit(1)
+	}
+	if *stream {
+		// 全行が揃ってから決まる値・並べ替えを使うオプションとは併用できない
+		if *format != "csv" && *format != "ndjson" {
+			fmt.Fprintln(os.Stderr, "ERROR: --stream requires --format csv or ndjson")
+			os.Exit(1)
+		}
+		for name, set := range map[string]bool{
+			"--max-rows-per-file": *maxRowsPerFile > 0,
+			"--percentile-ranks":  *percentileRanks || *percentileOnly,
+			"--with-consistency":  *withConsistency,
+			"--transform-cmd":     *transformCmd != "",
+			"--merge-by-email":    *mergeByEmail,
+			"--sqlite-out":        *sqliteOut != "",
+			"--min-prs":           *minPRs > 0,
+		} {
+			if set {
+				fmt.Fprintf(os.Stderr, "ERROR: --stream cannot be combined with %s\n", name)
+				os.Exit(1)
+			}
+		}
+	}
+	// --percentile-only は実数を出さないためのものなので、実数を書く出力とは併用させない
+	if *percentileOnly {
+		for _, c := range []struct {
+			name string
+			set  bool
+		}{
+			{"--with-grand-total", *withGrandTotal},
+			{"--totals-out", *totalsOut != ""},
+			{"--heatmap", *heatmapOut != ""},
+			{"--sqlite-out", *sqliteOut != ""},
+			{"--repo-summary", *repoSummary > 0},
+			{"--repo-health", *repoHealth},
+			{"--format openmetrics", *format == "openmetrics"},
+			{"--format treemap-json", *format == "treemap-json"},
+			{"--raw-out", *rawOut != ""},
+			{"--alert-threshold", *alertThreshold > 0},
+		} {
+			if c.set {
+				fmt.Fprintf(os.Stderr, "ERROR: --percentile-only cannot be combined with %s (it would expose raw totals)\n", c.name)
+				os.Exit(1)
+			}
+		}
+	}
+	if *uploadCmd != "" && *out == "" {
+		fmt.Fprintln(os.Stderr, "ERROR: --upload-cmd requires --out")
+		os.Exit(1)
+	}
+
+	var excludeRE *regexp.Regexp
+	if *excludeReposRE != "" {
+		var err error
+		excludeRE, err = regexp.Compile(*excludeReposRE)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: invalid --exclude-repos-regex: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	var repoGroup *regexp.Regexp
+	if *repoGroupRE != "" {
+		var err error
+		repoGroup, err = regexp.Compile(*repoGroupRE)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: invalid --repo-group-regex: %v\n", err)
+			os.Exit(1)
+		}
+		if repoGroup.NumSubexp() < 1 {
+			fmt.Fprintln(os.Stderr, "ERROR: --repo-group-regex needs a capture group, e.g. '^(team-[a-z]+)-'")
+			os.Exit(1)
+		}
+	}
+
+	if *explain {
+		explainOut = os.Stderr
+	}
+
+	rs, err := parseStatusSet(*retryStatusSpec)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: invalid --retry-statuses: %v\n", err)
+		os.Exit(1)
+	}
+	retryStatuses = rs
+	if *retryMax < 1 || *retryBaseMs < 0 || *retryMaxDelay < 0 {
+		fmt.Fprintln(os.Stderr, "ERROR: --retry-max must be >= 1 and --retry-base-ms / --retry-max-delay must be >= 0")
+		os.Exit(1)
+	}
+	retryBackoff = backoff{Attempts: *retryMax, Base: time.Duration(*retryBaseMs) * time.Millisecond, Max: *retryMaxDelay}
+	if *minRateRemain < 0 {
+		fmt.Fprintln(os.Stderr, "ERROR: --min-rate-remaining must be >= 0")
+		os.Exit(1)
+	}
+	minRateRemaining = *minRateRemain
+	if *cacheDir != "" {
+		if *cacheTTL < 0 {
+			fmt.Fprintln(os.Stderr, "ERROR: --cache-ttl must be >= 0")
+			os.Exit(1)
+		}
+		if err := os.MkdirAll(*cacheDir, 0o700); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: --cache-dir: %v\n", err)
+			os.Exit(1)
+		}
+		gqlCache = &responseCache{Dir: *cacheDir, TTL: *cacheTTL}
+		ttl := "forever"
+		if *cacheTTL > 0 {
+			ttl = "up to " + cacheTTL.String()
+		}
+		warnf("--cache-dir %s: API responses are reused for %s; results may be stale (for development only)\n", *cacheDir, ttl)
+	}
+
+	switch *scoreModeFlag {
+	case "touched", "sum", "additions", "net":
+		scoreMode = *scoreModeFlag
+	default:
+		fmt.Fprintf(os.Stderr, "ERROR: unknown --score-mode %q (touched|sum|additions|net)\n", *scoreModeFlag)
+		os.Exit(1)
+	}
+
+	if *topN < 0 {
+		fmt.Fprintln(os.Stderr, "ERROR: --top-n must be >= 0")
+		os.Exit(1)
+	}
+
+	sortKeys, err := parseSortKeys(*sortBy)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: invalid --sort-by: %v\n", err)
+		os.Exit(1)
+	}
+
+	token, tokenSource, err := resolveToken(*tokenFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %s %v\n", tokenSource, err)
+		os.Exit(1)
+	}
+	if token == "" {
+		fmt.Fprintln(os.Stderr, "ERROR: set GITHUB_ACCESS_TOKEN (or GITHUB_TOKEN / GH_TOKEN) env var, or pass --token-file, with a PAT that can read the org repos")
+		os.Exit(1)
+	}
+	if warn := tokenFormatWarning(token); warn != "" {
+		warnf("%s %s\n", tokenSource, warn)
+	}
+
+	// --all-branches のときは branches = nil (ベースブランチで絞らない)
+	// remote のときは repo ごとに refs から branchMatch で選ぶ
+	var branches []string
+	var branchMatch *regexp.Regexp
+	switch *branchSource {
+	case "remote", "candidates":
+	default:
+		fmt.Fprintf(os.Stderr, "ERROR: unknown --branch-source %q (remote|candidates)\n", *branchSource)
+		os.Exit(1)
+	}
+	if !*allBranches {
+		re := regexp.MustCompile(*branchesRE)
+		if *branchSource == "remote" {
+			branchMatch = re
+		} else {
+			// よく使うブランチ名から正規表現で抽出（必要なら拡張）
+			candidates := []string{"master", "main", "develop", "staging", "testing"}
+			for _, b := range candidates {
+				if re.MatchString(b) {
+					branches = append(branches, b)
+				}
+			}
+			if len(branches) == 0 {
+				warnf("no branches match regex; nothing to do\n")
+				return
+			}
+		}
+	}
+
+	states, err := parseStates(*statesFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: invalid --states: %v\n", err)
+		os.Exit(1)
+	}
+	switch *dateField {
+	case "merged", "created", "updated":
+	default:
+		fmt.Fprintf(os.Stderr, "ERROR: unknown --date-field %q (merged|created|updated)\n", *dateField)
+		os.Exit(1)
+	}
+	if *dateField == "merged" && (*sinceStr != "" || *untilStr != "") && (len(states) > 1 || states[0] != "MERGED") {
+		warnf("--states includes unmerged PRs but --date-field is merged; PRs without mergedAt are dropped by --since/--until (use --date-field created|updated)\n")
+	}
+	assocSet, err := parseAssociations(*associations)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: invalid --author-association: %v\n", err)
+		os.Exit(1)
+	}
+	var botRE *regexp.Regexp
+	if *excludeBots {
+		botRE, err = regexp.Compile(*botPattern)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: invalid --bot-pattern: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	lowerSet := func(s string) map[string]bool {
+		set := map[string]bool{}
+		for _, v := range splitList(s) {
+			set[strings.ToLower(v)] = true
+		}
+		return set
+	}
+	compilePaths := func(name, spec string) []pathPattern {
+		var out []pathPattern
+		for _, p := range splitList(spec) {
+			pp, err := compilePathPattern(p)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: invalid --%s pattern %q: %v\n", name, p, err)
+				os.Exit(1)
+			}
+			out = append(out, pp)
+		}
+		return out
+	}
+	includePathPatterns := compilePaths("include-paths", *includePaths)
+	excludePathPatterns := compilePaths("exclude-paths", *excludePaths)
+	authorSet := lowerSet(*authors)
+	filter := prFilter{
+		Since:        mustParseTimeOrZero(*sinceStr),
+		Until:        mustParseUntilOrZero(*untilStr),
+		DateField:    *dateField,
+		States:       states,
+		Milestone:    strings.TrimSpace(*milestone),
+		Associations: assocSet,
+		Authors:      authorSet,
+		Bots:         botRE,
+		Dedupe:       *dedupe,
+
+		GroupByMerger:          *groupBy == "merger",
+		DropUnknownAuthors:     *dropUnknown,
+		Period:                 *bucket,
+		IncludeLabels:          lowerSet(*includeLabels),
+		ExcludeLabels:          lowerSet(*excludeLabels),
+		MinLines:               *minLines,
+		CountDroppedEmpty:      *withEmptyPRs,
+		RequireResolvedThreads: *requireResolved,
+		KeepRaw:                *rawOut != "",
+		RespectGitattributes:   *respectAttrs,
+		PathPrefix:             strings.TrimPrefix(*pathPrefix, "/"),
+		IncludePaths:           includePathPatterns,
+		ExcludePaths:           excludePathPatterns,
+		IncludeReviews:         *includeReviews,
+	}
+
+	// --timeout は一覧取得から集計までの全 API 呼び出しの締め切り
+	ctx, cancel := context.WithCancel(context.Background())
+	if *timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), *timeout)
+	}
+	defer cancel()
+
+	generatedAt := time.Now()
+
+	// 1) org内の全repo取得 (--repo 指定時はその1件のみ)。--org が複数なら org ごとに一覧を取って連結する
+	var repos []repoRef
+	listed := map[repoRef]repoInfo{}            // 一覧 API で取得した repo の属性 (--dry-run 用)
+	var projectAggs map[repoRef]map[string]*agg // --project: PR はプロジェクトから取得済み
+	if *project > 0 {
+		byName, names, err := fetchProjectPRAgg(ctx, *endpoint, token, orgs[0], *project, filter)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR resolving --project: %v\n", err)
+			os.Exit(1)
+		}
+		// org 外のリポジトリも従来どおり repo 列 "owner/name" のまま --org の行として出す
+		projectAggs = map[repoRef]map[string]*agg{}
+		for _, name := range names {
+			ref := repoRef{Org: orgs[0], Name: name}
+			repos = append(repos, ref)
+			projectAggs[ref] = byName[name]
+		}
+	} else if *singleRepo != "" {
+		repos = []repoRef{{Org: orgs[0], Name: *singleRepo}}
+	} else if *reposList != "" {
+		for _, name := range splitList(*reposList) {
+			ref, err := parseRepoRef(name, orgs)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: invalid --repos: %v\n", err)
+				os.Exit(1)
+			}
+			repos = append(repos, ref)
+		}
+	} else if *reposFile != "" {
+		lines, err := readRepoList(*reposFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR reading --repos-file: %v\n", err)
+			os.Exit(1)
+		}
+		for _, line := range lines {
+			ref, err := parseRepoRef(line, orgs)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR reading --repos-file: %v\n", err)
+				os.Exit(1)
+			}
+			repos = append(repos, ref)
+		}
+	} else {
+		for _, o := range orgs {
+			// --max-repos は全 org 合わせての上限
+			limit := *maxRepos
+			if limit > 0 {
+				if limit -= len(repos); limit <= 0 {
+					break
+				}
+			}
+			kind := *ownerType
+			if kind == "auto" {
+				kind, err = resolveOwnerType(ctx, *endpoint, token, o)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "ERROR resolving --owner-type of %s: %v\n", o, err)
+					os.Exit(1)
+				}
+			}
+			fetch := fetchOrgRepos
+			if kind == "user" {
+				fetch = fetchUserRepos
+			}
+			infos, err := fetch(ctx, *endpoint, token, o, *includeForks, *includeArchived, *visibility, limit, *myRepos)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR fetching repos of org %s: %v\n", o, err)
+				os.Exit(1)
+			}
+			for _, info := range infos {
+				ref := repoRef{Org: o, Name: info.Name}
+				repos = append(repos, ref)
+				listed[ref] = info
+			}
+		}
+	}
+	if *excludeRepos != "" || excludeRE != nil {
+		before := len(repos)
+		repos = excludeRepoRefs(repos, splitList(*excludeRepos), excludeRE)
+		infof("Excluded %d of %d repos (--exclude-repos / --exclude-repos-regex)\n", before-len(repos), before)
+	}
+	if *dumpRepos != "" {
+		if err := writeRepoList(*dumpRepos, repoLabels(repos, len(orgs) > 1)); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR writing --dump-repos: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if *dryRun {
+		printDryRun(os.Stdout, repos, listed)
+		return
+	}
+	if len(repos) == 0 {
+		warnf("no repositories to scan\n")
+		return
+	}
+
+	if *estimateCost && projectAggs == nil {
+		listedRepos := 0
+		if *singleRepo == "" && *reposList == "" {
+			listedRepos = len(repos)
+		}
+		e := estimateScanCost(listedRepos, len(repos), len(branches), *maxPerBr, filter.RequireResolvedThreads, branchMatch != nil)
+		fmt.Fprintf(os.Stderr, "Estimate: %d repos x %d branch passes -> up to %d GraphQL requests (~%d rate-limit points, listing included)\n",
+			len(repos), e.passesPerRepo, e.requests, e.points)
+		if !*assumeYes && !confirm("Proceed with scan?") {
+			fmt.Fprintln(os.Stderr, "Aborted (use --yes to skip this prompt)")
+			return
+		}
+	}
+
+	// (任意) 走査前に org のチームを引いておく。read:org がなければここで止める
+	orgTeams := map[string]map[string][]string{}
+	if *byTeamFlag {
+		for _, repo := range repos {
+			if _, ok := orgTeams[repo.Org]; ok {
+				continue
+			}
+			teamsOf, err := fetchOrgTeams(ctx, *endpoint, token, repo.Org)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+				os.Exit(1)
+			}
+			orgTeams[repo.Org] = teamsOf
+		}
+	}
+
+	// 2) 各repoでPR集計 → org/author累計
+	var rows []row
+	orgTotals := map[string]*agg{} // 著者ごとの全repo合算
+	var firstWeek time.Time        // --since 未指定時の期間の始点
+	var skipped []skippedRepo
+	var scannedRepos []repoRef
+	repoAggs := map[repoRef]map[string]*agg{}
+
+	scanRepo := func(repo repoRef) (map[string]*agg, error) {
+		repoBranches := branches
+		if branchMatch != nil {
+			bs, err := fetchRepoBranches(ctx, *endpoint, token, repo.Org, repo.Name, branchMatch)
+			if err != nil {
+				return nil, err
+			}
+			if len(bs) == 0 {
+				// nil を渡すと全ブランチ扱いになるので、一致なしはここで空の結果にする
+				return map[string]*agg{}, nil
+			}
+			repoBranches = bs
+		}
+		return fetchRepoPRAgg(ctx, *endpoint, token, repo.Org, repo.Name, repoBranches, filter, *maxPerBr, *branchConc)
+	}
+
+	newRow := func(repo repoRef, user string, a *agg) row {
+		r := row{
+			Org:       repo.Org,
+			Repo:      repo.Name,
+			RepoGroup: repoGroupOf(repoGroup, repo.Name),
+			User:      user,
+			Additions: a.Additions,
+			Deletions: a.Deletions,
+			Net:       a.Additions - a.Deletions,
+			PRs:       a.PRs,
+			Files:     a.Files,
+			Score:     bucketScore(scoreOf(a.Additions, a.Deletions), *scoreBucket),
+			Milestone: joinSet(a.Milestones),
+
+			ActiveWeeks: len(a.Weeks),
+
+			LeadSamples:     len(a.LeadHours),
+			AvgLeadHours:    mean(a.LeadHours),
+			MedianLeadHours: median(a.LeadHours),
+
+			MedianPRSize: median(a.PRSizes),
+			P90PRSize:    int(nearestRank(a.PRSizes, 90)),
+			MaxPRSize:    int(nearestRank(a.PRSizes, 100)),
+
+			WeekdayPRs: a.WeekdayPRs,
+			WeekendPRs: a.WeekendPRs,
+			EmptyPRs:   a.EmptyPRs,
+
+			Decisions: a.Decisions,
+			Reviews:   a.Reviews,
+
+			FirstMerged: a.FirstMerged,
+			LastMerged:  a.LastMerged,
+		}
+		if idMap != nil && *groupBy != "team" {
+			r.Name = idMap.nameOf(user)
+			r.Team = idMap.teamOf(user)
+		}
+		return r
+	}
+	// --group-by team では repo ごとの結果を受け取った時点で著者をチームにまとめる
+	byTeam := func(perRepo map[string]*agg) map[string]*agg {
+		if *groupBy != "team" {
+			return perRepo
+		}
+		return remapLogins(perRepo, idMap.teamCanon(perRepo))
+	}
+	// --bucket 指定時は著者の行を期間ごとに分ける (org 合算・stderr の要約は期間をまとめた値のまま)
+	repoRows := func(repo repoRef, perRepo map[string]*agg) []row {
+		var rs []row
+		for user, a := range perRepo {
+			if filter.Period == "" {
+				rs = append(rs, newRow(repo, user, a))
+			}
+			for p, pa := range a.Periods {
+				r := newRow(repo, user, pa)
+				r.Period = p
+				rs = append(rs, r)
+			}
+		}
+		return rs
+	}
+
+	outOpts := outputOptions{WithRepoGroup: repoGroup != nil, WithPeriod: *bucket != "", WithScore: *withScore, WithMilestone: *withMilestone, WithConsistency: *withConsistency, WithLeadTime: *withLeadTime, WithPRSize: *withPRSize, WithFiles: *withFiles, WithEmptyPRs: *withEmptyPRs, WithWeekendSplit: *withWeekend, WithReviewDecision: *withDecision, WithReviews: *includeReviews,
+		ByTeam: *byTeamFlag, WithNet: *withNet, WithName: idMap != nil && *groupBy != "team", WithTeam: idMap != nil && idMap.hasTeams && *groupBy != "team",
+		PercentileRanks: *percentileRanks || *percentileOnly, HideRawCounts: *percentileOnly, WithDates: *withDates}
+	// --stream では repo が終わるたびにその repo の行だけ並べて書く (全体の並べ替えはしない)
+	var streamer *rowStreamer
+	streamedRows := 0
+	streamRepo := func(repo repoRef, perRepo map[string]*agg) {
+		rs := repoRows(repo, perRepo)
+		if *topPerRepo > 0 {
+			rs = limitPerRepo(rs, *topPerRepo)
+		}
+		sort.SliceStable(rs, func(i, j int) bool {
+			return compareRows(rs[i], rs[j], sortKeys) < 0
+		})
+		if err := streamer.write(rs); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR writing %s: %v\n", *format, err)
+			os.Exit(1)
+		}
+		streamedRows += len(rs)
+	}
+	if *stream {
+		streamer, err = newRowStreamer(*out, *format, *tee, outOpts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR writing %s: %v\n", *format, err)
+			os.Exit(1)
+		}
+	}
+
+	var pending []repoRef
+	for _, repo := range repos {
+		if perRepo, ok := projectAggs[repo]; ok {
+			perRepo = byTeam(perRepo)
+			repoAggs[repo] = perRepo
+			if streamer != nil {
+				streamRepo(repo, perRepo)
+			}
+			continue
+		}
+		pending = append(pending, repo)
+	}
+
+	// --concurrency 本のワーカーで repo を並行に取得する。結果はこの goroutine だけが集計に足す
+	type repoResult struct {
+		repo    repoRef
+		perRepo map[string]*agg
+		err     error
+	}
+	jobs := make(chan repoRef)
+	results := make(chan repoResult, len(pending))
+	started := make(chan repoRef, len(pending)) // --progress 用。表示はこの goroutine でまとめて行う
+	quit := make(chan struct{})                 // close すると未着手の repo を配らない
+	var wg sync.WaitGroup
+	for i := 0; i < *concurrency && i < len(pending); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for repo := range jobs {
+				started <- repo
+				m, err := scanRepo(repo)
+				results <- repoResult{repo, m, err}
+			}
+		}()
+	}
+	go func() {
+		defer close(jobs)
+		for _, repo := range pending {
+			// 両方 ready のときに配ってしまわないよう quit を先に見る
+			select {
+			case <-quit:
+				return
+			default:
+			}
+			select {
+			case jobs <- repo:
+			case <-quit:
+				return
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	// SIGINT/SIGTERM を受けたら実行中の repo だけ (猶予時間内で) 終わらせ、そこまでの結果を書き出して終了する
+	// --timeout に達したときも同様に、そこまでの結果を書き出す (実行中のリクエストは ctx で打ち切られる)
+	close(scanStarted)
+	sigDone, deadline := (<-chan os.Signal)(sigCh), ctx.Done()
+	interrupted := false
+	quitClosed := false
+	var grace <-chan time.Time
+	var scanErr error
+	skipReasons := map[repoRef]string{}
+	startedCount, countedPRs := 0, 0
+	failedRepos := 0 // --continue-on-error で飛ばした repo
+scan:
+	for {
+		select {
+		case repo := <-started:
+			startedCount++
+			if *progress {
+				fmt.Fprintf(os.Stderr, "[%d/%d] scanning %s ... (%d PRs counted so far)\n", startedCount, len(pending), repo, countedPRs)
+			}
+		case res, ok := <-results:
+			if !ok {
+				break scan
+			}
+			switch {
+			case ctx.Err() != nil && errors.Is(res.err, ctx.Err()):
+				warnf("dropping %s: %v\n", res.repo, res.err)
+			case errors.Is(res.err, errNoPRAccess):
+				warnf("skipping %s: token cannot read its pull requests (%v)\n", res.repo, res.err)
+				skipReasons[res.repo] = "no-pr-access"
+			case errors.Is(res.err, errRepoNotFound):
+				warnf("skipping %s: repository not found (%v)\n", res.repo, res.err)
+				skipReasons[res.repo] = "not-found"
+			case res.err != nil && *continueOnError:
+				warnf("%s failed, continuing with the remaining repos: %v\n", res.repo, res.err)
+				skipReasons[res.repo] = "error"
+				failedRepos++
+			case res.err != nil:
+				// 最初のエラーで配布を止め、実行中の repo が終わるのを待ってから終了する
+				if scanErr == nil {
+					scanErr = fmt.Errorf("%s: %w", res.repo, res.err)
+				}
+				if !quitClosed {
+					close(quit)
+					quitClosed = true
+				}
+			default:
+				res.perRepo = byTeam(res.perRepo)
+				repoAggs[res.repo] = res.perRepo
+				for _, a := range res.perRepo {
+					countedPRs += a.PRs
+				}
+				if streamer != nil {
+					streamRepo(res.repo, res.perRepo)
+				}
+			}
+		case <-sigDone:
+			if grace != nil {
+				// 2 回目のシグナルでは猶予を待たずに実行中の repo を捨て、そこまでの結果を書き出す
+				warnf("received a second signal; dropping repos still in flight\n")
+				cancel()
+				break scan
+			}
+			interrupted = true
+			if !quitClosed {
+				close(quit)
+				quitClosed = true
+			}
+			warnf("received signal; finishing in-flight repos (grace %s) then writing partial results\n", *shutdownGrace)
+			grace = time.After(*shutdownGrace)
+		case <-deadline:
+			deadline = nil
+			interrupted = true
+			if !quitClosed {
+				close(quit)
+				quitClosed = true
+			}
+			warnf("--timeout %s reached; writing partial results\n", *timeout)
+		case <-grace:
+			warnf("grace period expired; dropping repos still in flight\n")
+			cancel()
+			break scan
+		}
+	}
+	signal.Stop(sigCh)
+	if scanErr != nil {
+		fmt.Fprintf(os.Stderr, "ERROR on %v\n", scanErr)
+		os.Exit(1)
+	}
+	if failedRepos > 0 && failedRepos == len(pending) {
+		fmt.Fprintf(os.Stderr, "ERROR: all %d repos failed (see the WARN lines above)\n", failedRepos)
+		os.Exit(1)
+	}
+
+	// 完了順に依らないよう repo 一覧の順に並べ直す
+	for _, repo := range repos {
+		if _, ok := repoAggs[repo]; ok {
+			scannedRepos = append(scannedRepos, repo)
+		} else if reason, ok := skipReasons[repo]; ok {
+			skipped = append(skipped, skippedRepo{Repo: repo, Reason: reason})
+		}
 	}
 
-	var rows []row
-	orgTotals := map[string]*agg{} // 著者ごとの全repo合算
-	for _, repo := range repos {
-		perRepo, err := fetchRepoPRAgg(token, *org, repo, branches, since, until, *maxPerBr)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "ERROR on %s/%s: %v\n", *org, repo, err)
-			os.Exit(1)
+	// (任意) 公開メールが同じ login を1人にまとめる
+	if *mergeByEmail {
+		canon := resolveEmailIdentities(ctx, *endpoint, token, repoAggs)
+		for repo, m := range repoAggs {
+			repoAggs[repo] = remapLogins(m, canon)
 		}
-		for user, a := range perRepo {
-			rows = append(rows, row{
-				Org:       *org,
-				Repo:      repo,
-				User:      user,
-				Additions: a.Additions,
-				Deletions: a.Deletions,
-				PRs:       a.PRs,
-				Score:     a.Additions + abs(a.Deletions),
-			})
+	}
+
+	for _, repo := range scannedRepos {
+		for user, a := range repoAggs[repo] {
+			for wk := range a.Weeks {
+				if t, err := time.ParseInLocation("2006-01-02", wk, reportLoc); err == nil && (firstWeek.IsZero() || t.Before(firstWeek)) {
+					firstWeek = t
+				}
+			}
 			t := orgTotals[user]
 			if t == nil {
 				t = &agg{}
 				orgTotals[user] = t
 			}
-			t.Additions += a.Additions
-			t.Deletions += a.Deletions
-			t.PRs += a.PRs
+			t.merge(a)
+		}
+		if streamer == nil {
+			rows = append(rows, repoRows(repo, repoAggs[repo])...)
 		}
 	}
 
-	// 並びは touched lines 降順（additions + |deletions|）
-	sort.Slice(rows, func(i, j int) bool {
-		if rows[i].Score == rows[j].Score {
-			if rows[i].User == rows[j].User {
-				if rows[i].Org == rows[j].Org {
-					return rows[i].Repo < rows[j].Repo
+	// --min-prs: org 合算の PR 数が N 未満の著者を、全 repo の行・合算・要約から除く。
+	// 判定するのは PR を書いた人だけで、--include-reviews のレビューだけの行 (PR 0 件) は残す
+	if *minPRs > 0 {
+		dropped := map[string]bool{}
+		for user, a := range orgTotals {
+			if a.PRs == 0 && len(a.Reviews) > 0 {
+				continue
+			}
+			if a.PRs < *minPRs {
+				dropped[user] = true
+				delete(orgTotals, user)
+			}
+		}
+		for _, m := range repoAggs {
+			for user := range m {
+				if dropped[user] {
+					delete(m, user)
 				}
-				return rows[i].Org < rows[j].Org
 			}
-			return rows[i].User < rows[j].User
 		}
-		return rows[i].Score > rows[j].Score
+		kept := rows[:0]
+		for _, r := range rows {
+			if !dropped[r.User] {
+				kept = append(kept, r)
+			}
+		}
+		rows = kept
+		if len(dropped) > 0 {
+			infof("Dropped %d authors with fewer than %d PRs in total (--min-prs)\n", len(dropped), *minPRs)
+		}
+	}
+
+	// --by-team: 行を org × チームに置き換える (org 合算・stderr の要約は著者単位のまま)
+	if *byTeamFlag {
+		rows = nil
+		teamAggs := aggregateByTeam(scannedRepos, repoAggs, orgTeams, splitList(*teamPriority))
+		teamOrgs := make([]string, 0, len(teamAggs))
+		for o := range teamAggs {
+			teamOrgs = append(teamOrgs, o)
+		}
+		sort.Strings(teamOrgs)
+		for _, o := range teamOrgs {
+			for _, r := range repoRows(repoRef{Org: o}, teamAggs[o]) {
+				r.Team, r.User = r.User, ""
+				rows = append(rows, r)
+			}
+		}
+	}
+
+	if *percentileRanks || *percentileOnly {
+		addP, delP, scoreP := percentileRanksOf(orgTotals)
+		for i := range rows {
+			rows[i].AdditionsPctl = addP[rows[i].User]
+			rows[i].DeletionsPctl = delP[rows[i].User]
+			rows[i].ScorePctl = scoreP[rows[i].User]
+		}
+	}
+
+	if *withConsistency {
+		from, to := filter.Since, filter.Until
+		if from.IsZero() {
+			from = firstWeek
+		}
+		if to.IsZero() {
+			to = time.Now()
+		}
+		if total := countWeeks(from, to); total > 0 {
+			for i := range rows {
+				rows[i].Consistency = float64(rows[i].ActiveWeeks) / float64(total)
+			}
+		}
+	}
+
+	if *transformCmd != "" {
+		rows, err = runTransformCmd(*transformCmd, rows)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: --transform-cmd: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if *topPerRepo > 0 {
+		rows = limitPerRepo(rows, *topPerRepo)
+	}
+
+	// 並びはデフォルトで touched lines 降順（additions + |deletions|）
+	sort.SliceStable(rows, func(i, j int) bool {
+		return compareRows(rows[i], rows[j], sortKeys) < 0
 	})
 
 	// 出力
-	var w io.Writer = os.Stdout
-	if *out != "" {
-		f, err := os.Create(*out)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "ERROR creating %s: %v\n", *out, err)
+	if *out == "" && *tee {
+		warnf("--tee has no effect without --out\n")
+	}
+	outOpts.Meta = reportMeta{Org: strings.Join(orgs, ","), Since: filter.Since, Until: filter.Until, Repos: len(scannedRepos), States: filter.states()}
+	if *withGrandTotal {
+		t := row{Org: strings.Join(orgs, ",")}
+		for _, a := range orgTotals {
+			t.Additions += a.Additions
+			t.Deletions += a.Deletions
+			t.PRs += a.PRs
+			t.Files += a.Files
+		}
+		t.Net = t.Additions - t.Deletions
+		t.Score = scoreOf(t.Additions, t.Deletions)
+		outOpts.GrandTotal = &t
+	}
+	if *withProvenance {
+		outOpts.Footer = []string{
+			"org=" + strings.Join(orgs, ","),
+			"since=" + fmtBound(filter.Since),
+			"until=" + fmtBound(filter.Until),
+			"date_field=" + filter.dateField(),
+			"tool=pr-lines-by-author-org " + toolVersion(),
+			"generated_at=" + generatedAt.UTC().Format(time.RFC3339),
+		}
+	}
+	// --max-rows-per-file 指定時は out-1.csv, out-2.csv ... に分割する
+	parts := []outputPart{{Path: *out, Rows: rows, Opts: outOpts}}
+	if *maxRowsPerFile > 0 && *out != "" {
+		parts = splitOutput(*out, rows, outOpts, *maxRowsPerFile)
+	}
+	if streamer != nil {
+		if err := streamer.close(outOpts); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR writing %s: %v\n", *format, err)
 			os.Exit(1)
 		}
-		defer f.Close()
-		w = f
+	} else {
+		for _, p := range parts {
+			if err := writeOutputFile(p, *format, *tee, generatedAt); err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR writing %s: %v\n", *format, err)
+				os.Exit(1)
+			}
+		}
 	}
-	cw := csv.NewWriter(w)
-	_ = cw.Write([]string{"org", "repo", "user", "additions", "deletions", "prs"})
-	for _, r := range rows {
-		_ = cw.Write([]string{
-			r.Org, r.Repo, r.User,
-			fmt.Sprintf("%d", r.Additions),
-			fmt.Sprintf("%d", r.Deletions),
-			fmt.Sprintf("%d", r.PRs),
-		})
+	if *rawOut != "" {
+		if err := writeRawFile(*rawOut, scannedRepos, repoAggs); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR writing %s: %v\n", *rawOut, err)
+			os.Exit(1)
+		}
 	}
-	cw.Flush()
-	if err := cw.Error(); err != nil {
-		fmt.Fprintf(os.Stderr, "ERROR writing csv: %v\n", err)
-		os.Exit(1)
+	if *totalsOut != "" {
+		if err := writeTotalsFile(*totalsOut, scannedRepos, repoAggs, *scoreBucket); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR writing %s: %v\n", *totalsOut, err)
+			os.Exit(1)
+		}
+	}
+	if *repoActivity != "" {
+		if err := writeRepoActivityFile(*repoActivity, scannedRepos, repoAggs, len(orgs) > 1); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR writing %s: %v\n", *repoActivity, err)
+			os.Exit(1)
+		}
+	}
+	if *heatmapOut != "" {
+		if err := writeHeatmapFile(*heatmapOut, orgTotals); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR writing %s: %v\n", *heatmapOut, err)
+			os.Exit(1)
+		}
+	}
+	if *sqliteOut != "" {
+		if err := writeSQLite(*sqliteOut, rows, generatedAt); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR writing %s: %v\n", *sqliteOut, err)
+			os.Exit(1)
+		}
+	}
+	if *uploadCmd != "" {
+		for _, p := range parts {
+			code, err := runUploadCmd(*uploadCmd, p.Path)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR running --upload-cmd for %s: %v\n", p.Path, err)
+				os.Exit(1)
+			}
+			if code != 0 {
+				fmt.Fprintf(os.Stderr, "ERROR: --upload-cmd for %s exited with status %d\n", p.Path, code)
+				os.Exit(1)
+			}
+			infof("upload-cmd for %s exited with status 0\n", p.Path)
+		}
 	}
 
 	// 参考: 組織合算を最後にstderrで軽く要約
@@ -461,7 +2947,10 @@ func main() {
 		Additions int
 		Deletions int
 		PRs       int
+		Files     int
 		Score     int
+		First     time.Time
+		Last      time.Time
 	}
 	var sumRows []sumRow
 	for user, a := range orgTotals {
@@ -470,7 +2959,10 @@ func main() {
 			Additions: a.Additions,
 			Deletions: a.Deletions,
 			PRs:       a.PRs,
-			Score:     a.Additions + abs(a.Deletions),
+			Files:     a.Files,
+			Score:     bucketScore(scoreOf(a.Additions, a.Deletions), *scoreBucket),
+			First:     a.FirstMerged,
+			Last:      a.LastMerged,
 		})
 	}
 	sort.Slice(sumRows, func(i, j int) bool {
@@ -479,11 +2971,573 @@ func main() {
 		}
 		return sumRows[i].Score > sumRows[j].Score
 	})
-	fmt.Fprintf(os.Stderr, "Scanned %d repos. Top contributors (org total):\n", len(repos))
-	for i := 0; i < len(sumRows) && i < 10; i++ {
+	if len(skipped) > 0 {
+		infof("Skipped %d repos:\n", len(skipped))
+		for _, sk := range skipped {
+			infof("  %s (%s)\n", sk.Repo, sk.Reason)
+		}
+	}
+	totalLabel := "org total"
+	if len(orgs) > 1 {
+		totalLabel = fmt.Sprintf("total across %d orgs", len(orgs))
+	}
+	// --top-n 0 では要約 (Scanned 行と上位一覧、API 使用量) を出さない。警告は出す
+	if *topN > 0 {
+		infof("Scanned %d repos. Top contributors (%s):\n", len(scannedRepos), totalLabel)
+	}
+	var scorePctl map[string]int
+	if *percentileOnly {
+		_, _, scorePctl = percentileRanksOf(orgTotals)
+	}
+	for i := 0; i < len(sumRows) && i < *topN; i++ {
 		s := sumRows[i]
-		fmt.Fprintf(os.Stderr, "  %d) %-20s  +%d / -%d  PRs:%d\n", i+1, s.User, s.Additions, s.Deletions, s.PRs)
+		line := fmt.Sprintf("  %d) %-20s  +%d / -%d  PRs:%d", i+1, s.User, s.Additions, s.Deletions, s.PRs)
+		if scorePctl != nil {
+			// --percentile-only: 要約にも実数の行数を出さない
+			line = fmt.Sprintf("  %d) %-20s  score_pctl:%d  PRs:%d", i+1, s.User, scorePctl[s.User], s.PRs)
+		}
+		if *withFiles && s.PRs > 0 {
+			line += fmt.Sprintf("  files/PR:%.1f", float64(s.Files)/float64(s.PRs))
+		}
+		if *withDates {
+			line += fmt.Sprintf("  first_merged:%s  last_merged:%s", fmtRawTime(s.First), fmtRawTime(s.Last))
+		}
+		infof("%s\n", line)
+	}
+	if idMap != nil && len(idMap.missing) > 0 {
+		warnf("%d logins are not in --identity-map and are shown as-is\n", len(idMap.missing))
+	}
+	if failedRepos > 0 {
+		warnf("%d of %d repos failed and are missing from the output (--continue-on-error)\n", failedRepos, len(pending))
+	}
+	if *excludeBots {
+		infof("Excluded %d PRs by bot authors (--bot-pattern %s)\n", botPRsExcluded.Load(), *botPattern)
+	}
+	if *topN > 0 {
+		infof("%s\n", apiStats.summary())
+	}
+
+	if *repoSummary > 0 {
+		printRepoSummary(os.Stderr, scannedRepos, repoAggs, *repoSummary)
+	}
+	if *repoHealth {
+		printRepoHealth(os.Stderr, scannedRepos, repoAggs)
+	}
+
+	if *expectedFile != "" {
+		expected, err := readRepoList(*expectedFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR reading --expected-authors-file: %v\n", err)
+			os.Exit(1)
+		}
+		printReconciliation(os.Stderr, expected, orgTotals)
+	}
+
+	if *alertThreshold > 0 {
+		if alerts := thresholdAlerts(orgTotals, *alertThreshold, splitList(*alertAuthors)); len(alerts) > 0 {
+			for _, a := range alerts {
+				fmt.Fprintln(os.Stderr, "ALERT: "+a)
+			}
+			os.Exit(exitAlert)
+		}
+	}
+
+	if interrupted {
+		warnf("interrupted; output contains %d of %d repos\n", len(scannedRepos), len(repos))
+		os.Exit(exitInterrupted)
+	}
+
+	// CI 向けのゲート。期間の指定ミスやトークンの権限不足で空になったのを検知する
+	if len(rows)+streamedRows == 0 {
+		if *failIfEmpty {
+			fmt.Fprintln(os.Stderr, "ERROR: no contributor rows (--fail-if-empty)")
+			os.Exit(exitGate)
+		}
+		warnf("no contributor rows in the output (check --since/--until, filters and token scopes)\n")
+	}
+	if *minTotalPRs > 0 {
+		total := 0
+		for _, a := range orgTotals {
+			total += a.PRs
+		}
+		if total < *minTotalPRs {
+			fmt.Fprintf(os.Stderr, "ERROR: %d PRs counted, fewer than --min-total-prs %d\n", total, *minTotalPRs)
+			os.Exit(exitGate)
+		}
+	}
+}
+
+// 著者ごとの org 合算値の百分位: 値が自分以下の著者の割合 (%)。最上位は 100
+func percentileRanksOf(totals map[string]*agg) (adds, dels, scores map[string]int) {
+	rank := func(value func(a *agg) int) map[string]int {
+		vals := make([]int, 0, len(totals))
+		for _, a := range totals {
+			vals = append(vals, value(a))
+		}
+		sort.Ints(vals)
+		out := make(map[string]int, len(totals))
+		for user, a := range totals {
+			v := value(a)
+			le := sort.Search(len(vals), func(i int) bool { return vals[i] > v })
+			out[user] = le * 100 / len(vals)
+		}
+		return out
+	}
+	adds = rank(func(a *agg) int { return a.Additions })
+	dels = rank(func(a *agg) int { return abs(a.Deletions) })
+	scores = rank(func(a *agg) int { return scoreOf(a.Additions, a.Deletions) })
+	return adds, dels, scores
+}
+
+// 想定メンバーと実際の著者の突き合わせ。login は大文字小文字を区別しない。
+// ファイルは 1 行 1 login (CSV の場合は先頭列を使う)
+func printReconciliation(w io.Writer, expected []string, totals map[string]*agg) {
+	active := map[string]string{} // lower -> 実際の login
+	for user, a := range totals {
+		if a.PRs > 0 {
+			active[strings.ToLower(user)] = user
+		}
+	}
+	want := map[string]bool{}
+	var inactive []string
+	for _, line := range expected {
+		login := strings.TrimSpace(strings.SplitN(line, ",", 2)[0])
+		key := strings.ToLower(login)
+		if login == "" || want[key] {
+			continue
+		}
+		want[key] = true
+		if _, ok := active[key]; !ok {
+			inactive = append(inactive, login)
+		}
+	}
+	var unexpected []string
+	for key, user := range active {
+		if !want[key] {
+			unexpected = append(unexpected, user)
+		}
+	}
+	sort.Strings(inactive)
+	sort.Strings(unexpected)
+	fmt.Fprintf(w, "Reconciliation: %d expected, %d active\n", len(want), len(active))
+	fmt.Fprintf(w, "  Expected but no activity (%d):\n", len(inactive))
+	for _, u := range inactive {
+		fmt.Fprintf(w, "    %s\n", u)
+	}
+	fmt.Fprintf(w, "  Active but not expected (%d):\n", len(unexpected))
+	for _, u := range unexpected {
+		fmt.Fprintf(w, "    %s\n", u)
+	}
+}
+
+// additions / deletions 比の目安。これを超えると growing、下回ると shrinking
+const (
+	healthGrowingRatio   = 3.0
+	healthShrinkingRatio = 1.0
+)
+
+// touched lines (全著者の合計) が多い順に上位 n リポジトリを表示する
+func printRepoSummary(w io.Writer, repos []repoRef, repoAggs map[repoRef]map[string]*agg, n int) {
+	type repoTotal struct {
+		repo       repoRef
+		adds, dels int
+		prs        int
+	}
+	totals := make([]repoTotal, 0, len(repos))
+	for _, repo := range repos {
+		t := repoTotal{repo: repo}
+		for _, a := range repoAggs[repo] {
+			t.adds += a.Additions
+			t.dels += abs(a.Deletions)
+			t.prs += a.PRs
+		}
+		totals = append(totals, t)
+	}
+	sort.SliceStable(totals, func(i, j int) bool { return totals[i].adds+totals[i].dels > totals[j].adds+totals[j].dels })
+	fmt.Fprintf(w, "Top repos by touched lines (%d of %d):\n", min(n, len(totals)), len(totals))
+	for i := 0; i < len(totals) && i < n; i++ {
+		t := totals[i]
+		fmt.Fprintf(w, "  %d) %s/%-30s  +%d / -%d  PRs:%d\n", i+1, t.repo.Org, t.repo.Name, t.adds, t.dels, t.prs)
+	}
+}
+
+// repo ごとの additions/deletions 比。deletions が 0 なら比は無限大扱い
+func printRepoHealth(w io.Writer, repos []repoRef, repoAggs map[repoRef]map[string]*agg) {
+	fmt.Fprintln(w, "Repo health (additions/deletions ratio):")
+	for _, repo := range repos {
+		var adds, dels int
+		for _, a := range repoAggs[repo] {
+			adds += a.Additions
+			dels += abs(a.Deletions)
+		}
+		if adds == 0 && dels == 0 {
+			continue
+		}
+		ratio, label := "inf", "growing"
+		if dels > 0 {
+			r := float64(adds) / float64(dels)
+			ratio = fmt.Sprintf("%.2f", r)
+			switch {
+			case r > healthGrowingRatio:
+				label = "growing"
+			case r < healthShrinkingRatio:
+				label = "shrinking"
+			default:
+				label = "balanced"
+			}
+		}
+		fmt.Fprintf(w, "  %s/%-30s  +%d / -%d  ratio:%s  %s\n", repo.Org, repo.Name, adds, dels, ratio, label)
+	}
+}
+
+const (
+	// --alert-threshold を超えた著者がいたときの終了コード
+	exitAlert = 3
+	// シグナルで中断し、途中までの結果を書き出して終了したときの終了コード
+	exitInterrupted = 4
+	// --fail-if-empty / --min-total-prs の条件に当たったときの終了コード
+	exitGate = 5
+)
+
+// touched lines が threshold を超えた監視対象の著者ごとのメッセージ。authors が空なら全員が対象
+func thresholdAlerts(totals map[string]*agg, threshold int, authors []string) []string {
+	watch := map[string]bool{}
+	for _, a := range authors {
+		watch[strings.ToLower(a)] = true
+	}
+	var users []string
+	for user := range totals {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	var out []string
+	for _, user := range users {
+		if len(watch) > 0 && !watch[strings.ToLower(user)] {
+			continue
+		}
+		a := totals[user]
+		if touched := a.Additions + abs(a.Deletions); touched > threshold {
+			out = append(out, fmt.Sprintf("%s touched %d lines (+%d / -%d), above threshold %d", user, touched, a.Additions, a.Deletions, threshold))
+		}
+	}
+	return out
+}
+
+type costEstimate struct {
+	passesPerRepo int
+	requests      int
+	points        int
+}
+
+// 上限ベースの見積もり（実際はページが早く尽きればもっと少ない）。
+// 1リクエストは first:100 の接続1つでおおむね1ポイント。レビュースレッドを取る場合は
+// PR 100件 x スレッド 100件分のノードが加わるので 1 ポイント上乗せで見積もる。
+// remoteBranches では実ブランチ数が事前に分からないので 1 repo 1 パス + refs 取得 1 回で見積もる
+func estimateScanCost(listedRepos, repos, branches, maxPerBranch int, threads, remoteBranches bool) costEstimate {
+	passes := branches
+	if passes == 0 {
+		passes = 1 // --all-branches / remote
+	}
+	pagesPerPass := (maxPerBranch + 99) / 100
+	if pagesPerPass < 1 {
+		pagesPerPass = 1
+	}
+	listing := 0
+	if listedRepos > 0 {
+		listing = (listedRepos + 99) / 100
+	}
+	if remoteBranches {
+		listing += repos
+	}
+	prRequests := repos * passes * pagesPerPass
+	pointsPerPR := 1
+	if threads {
+		pointsPerPR = 2
+	}
+	return costEstimate{
+		passesPerRepo: passes,
+		requests:      listing + prRequests,
+		points:        listing + prRequests*pointsPerPR,
+	}
+}
+
+// stdin から y/yes を読めたら true。EOF などは false
+func confirm(prompt string) bool {
+	fmt.Fprintf(os.Stderr, "%s [y/N]: ", prompt)
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		fmt.Fprintln(os.Stderr)
+		return false
+	}
+	switch strings.ToLower(strings.TrimSpace(line)) {
+	case "y", "yes":
+		return true
+	}
+	return false
+}
+
+// 1行1リポジトリ名。空行と # で始まる行は無視する
+func readRepoList(path string) ([]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var repos []string
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		repos = append(repos, line)
+	}
+	return repos, nil
+}
+
+// names (名前または org/name の完全一致) か re (名前に対して) に一致する repo を除く
+func excludeRepoRefs(repos []repoRef, names []string, re *regexp.Regexp) []repoRef {
+	drop := map[string]bool{}
+	for _, n := range names {
+		drop[n] = true
+	}
+	out := repos[:0]
+	for _, r := range repos {
+		if drop[r.Name] || drop[r.String()] || (re != nil && re.MatchString(r.Name)) {
+			continue
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+// --dry-run: 走査対象の repo と属性を1行ずつ出し、最後に件数を出す。
+// --repo / --repos-file で一覧を取得していない repo の属性は "-"
+func printDryRun(w io.Writer, repos []repoRef, listed map[repoRef]repoInfo) {
+	for _, r := range repos {
+		info, ok := listed[r]
+		if !ok {
+			fmt.Fprintf(w, "%-40s  fork=-  archived=-  private=-\n", r)
+			continue
+		}
+		fmt.Fprintf(w, "%-40s  fork=%t  archived=%t  private=%t\n", r, info.IsFork, info.IsArchived, info.IsPrivate)
+	}
+	fmt.Fprintf(w, "%d repos\n", len(repos))
+}
+
+// 複数 org のときは "org/name" (--repos-file でそのまま読める)、それ以外は名前だけ
+func repoLabels(repos []repoRef, qualified bool) []string {
+	out := make([]string, len(repos))
+	for i, r := range repos {
+		out[i] = r.Name
+		if qualified {
+			out[i] = r.String()
+		}
+	}
+	return out
+}
+
+func writeRepoList(path string, repos []string) error {
+	f, err := createAtomic(path)
+	if err != nil {
+		return err
+	}
+	defer f.Abort()
+	for _, r := range repos {
+		if _, err := fmt.Fprintln(f, r); err != nil {
+			return err
+		}
+	}
+	return f.Commit()
+}
+
+// 正規表現の最初のキャプチャグループ。マッチしなければ空
+func repoGroupOf(re *regexp.Regexp, repo string) string {
+	if re == nil {
+		return ""
+	}
+	m := re.FindStringSubmatch(repo)
+	if len(m) < 2 {
+		return ""
+	}
+	return m[1]
+}
+
+// repo ごと (--bucket では repo × 期間ごと) に score 上位 k 件だけ残す。同点は user 昇順
+func limitPerRepo(rows []row, k int) []row {
+	byRepo := map[[3]string][]row{}
+	var order [][3]string
+	for _, r := range rows {
+		key := [3]string{r.Org, r.Repo, r.Period}
+		if _, ok := byRepo[key]; !ok {
+			order = append(order, key)
+		}
+		byRepo[key] = append(byRepo[key], r)
+	}
+	out := make([]row, 0, len(rows))
+	for _, key := range order {
+		rs := byRepo[key]
+		sort.Slice(rs, func(i, j int) bool {
+			if rs[i].Score == rs[j].Score {
+				return rs[i].User < rs[j].User
+			}
+			return rs[i].Score > rs[j].Score
+		})
+		if len(rs) > k {
+			rs = rs[:k]
+		}
+		out = append(out, rs...)
+	}
+	return out
+}
+
+// 生成済みファイルを外部コマンドに渡す。{path} はシェル用にクォートして置換し、stdin にも内容を流す
+func runUploadCmd(tmpl, path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	quoted := "'" + strings.ReplaceAll(path, "'", `'\''`) + "'"
+	cmd := exec.Command("sh", "-c", strings.ReplaceAll(tmpl, "{path}", quoted))
+	cmd.Stdin = f
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return exitErr.ExitCode(), nil
+		}
+		return 0, err
+	}
+	return 0, nil
+}
+
+// t を含む週の月曜 0:00 (reportLoc)
+func weekStart(t time.Time) time.Time {
+	t = t.In(reportLoc)
+	d := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, reportLoc)
+	offset := (int(d.Weekday()) + 6) % 7 // 月曜=0
+	return d.AddDate(0, 0, -offset)
+}
+
+// from〜to にまたがる週の数 (両端の週を含む)
+func countWeeks(from, to time.Time) int {
+	a, b := weekStart(from), weekStart(to)
+	if b.Before(a) {
+		return 0
+	}
+	// 夏時間の切り替えを含む週は 167h / 169h なので日数に丸めてから数える
+	days := int(b.Sub(a).Round(24*time.Hour).Hours() / 24)
+	return days/7 + 1
+}
+
+func mean(xs []float64) float64 {
+	if len(xs) == 0 {
+		return 0
+	}
+	var sum float64
+	for _, x := range xs {
+		sum += x
+	}
+	return sum / float64(len(xs))
+}
+
+func median(xs []float64) float64 {
+	if len(xs) == 0 {
+		return 0
+	}
+	s := append([]float64(nil), xs...)
+	sort.Float64s(s)
+	m := len(s) / 2
+	if len(s)%2 == 0 {
+		return (s[m-1] + s[m]) / 2
+	}
+	return s[m]
+}
+
+// 最近傍順位法の p パーセンタイル (1-100)。p=100 で最大値
+func nearestRank(xs []float64, p int) float64 {
+	if len(xs) == 0 {
+		return 0
+	}
+	s := append([]float64(nil), xs...)
+	sort.Float64s(s)
+	i := (p*len(s) + 99) / 100
+	if i < 1 {
+		i = 1
+	}
+	return s[i-1]
+}
+
+// rows を JSON 配列で外部コマンドの stdin に渡し、stdout の JSON 配列を新しい rows として受け取る。
+// 未知のキーや org/repo/user の欠けた行はエラーにする
+func runTransformCmd(command string, rows []row) ([]row, error) {
+	in, err := json.Marshal(rows)
+	if err != nil {
+		return nil, err
+	}
+	var stdout bytes.Buffer
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stdin = bytes.NewReader(in)
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("command failed: %w", err)
+	}
+	dec := json.NewDecoder(&stdout)
+	dec.DisallowUnknownFields()
+	var out []row
+	if err := dec.Decode(&out); err != nil {
+		return nil, fmt.Errorf("invalid JSON on stdout (want an array of row objects): %w", err)
+	}
+	if dec.More() {
+		return nil, errors.New("invalid JSON on stdout: trailing data after the array")
+	}
+	for i, r := range out {
+		if r.Org == "" || r.Repo == "" || r.User == "" {
+			return nil, fmt.Errorf("row %d: org, repo and user are required", i)
+		}
+	}
+	return out, nil
+}
+
+// set のキーをソートして ";" 区切りで連結
+func joinSet(set map[string]bool) string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ";")
+}
+
+// score の定義 (--score-mode)
+var scoreMode = "touched"
+
+// touched: additions + |deletions| / sum: additions + deletions (符号そのまま) /
+// additions: additions のみ / net: additions - deletions (純増)
+func scoreOf(additions, deletions int) int {
+	switch scoreMode {
+	case "sum":
+		return additions + deletions
+	case "additions":
+		return additions
+	case "net":
+		return additions - deletions
+	}
+	return additions + abs(deletions)
+}
+
+// n > 0 なら score を n の倍数に切り捨てる (例: n=100 で 1299 -> 1200、-1299 -> -1300)
+func bucketScore(score, n int) int {
+	if n <= 0 {
+		return score
+	}
+	// Go の / は 0 方向に丸めるので、負の値 (--score-mode net) は 1 つ下の倍数にする
+	q := score / n
+	if score%n != 0 && score < 0 {
+		q--
 	}
+	return q * n
 }
 
 func abs(n int) int {
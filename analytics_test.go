@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// PR ノード 1 件の JSON (fetchRepoPRAgg の応答用)
+func prJSON(number int, login string, additions, deletions int) string {
+	return fmt.Sprintf(`{"number":%d,"state":"MERGED","mergedAt":"2024-01-02T00:00:00Z","createdAt":"2024-01-01T00:00:00Z","updatedAt":"2024-01-02T00:00:00Z","additions":%d,"deletions":%d,"changedFiles":1,"baseRefName":"main","author":{"login":%q}}`,
+		number, additions, deletions, login)
+}
+
+// RepoPullRequests の 1 ページ (続きなし)
+func prPage(nodes ...string) string {
+	return `{"data":{"repository":{"pullRequests":{"pageInfo":{"hasNextPage":false,"endCursor":""},"nodes":[` + strings.Join(nodes, ",") + `]}}}}`
+}
+
+func TestFetchRepoPRAggBranches(t *testing.T) {
+	// main に 2 件、develop に 1 件。#1 は develop にも付け替え前の分が残っている
+	byBase := map[interface{}]string{
+		"main":    prPage(prJSON(1, "alice", 10, 5), prJSON(2, "alice", 3, 0)),
+		"develop": prPage(prJSON(3, "bob", 7, 1), prJSON(1, "alice", 10, 5)),
+		nil:       prPage(prJSON(1, "alice", 10, 5), prJSON(2, "alice", 3, 0), prJSON(3, "bob", 7, 1)),
+	}
+	tests := []struct {
+		name        string
+		branches    []string
+		concurrency int
+		dedupe      bool
+		wantPRs     map[string]int
+		wantAdds    map[string]int
+		wantReqs    int
+	}{
+		{"serial", []string{"main", "develop"}, 1, false, map[string]int{"alice": 3, "bob": 1}, map[string]int{"alice": 23, "bob": 7}, 2},
+		{"parallel", []string{"main", "develop"}, 2, false, map[string]int{"alice": 3, "bob": 1}, map[string]int{"alice": 23, "bob": 7}, 2},
+		{"dedupe", []string{"main", "develop"}, 2, true, map[string]int{"alice": 2, "bob": 1}, map[string]int{"alice": 13, "bob": 7}, 2},
+		{"all branches", nil, 1, false, map[string]int{"alice": 2, "bob": 1}, map[string]int{"alice": 13, "bob": 7}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			quietGlobals(t)
+			f, endpoint := newFakeGraphQL(t, func(_ int, req graphQLRequest) (int, string) {
+				return http.StatusOK, byBase[req.Variables["base"]]
+			})
+			totals, err := fetchRepoPRAgg(context.Background(), endpoint, "tok", "acme", "r1", tt.branches, prFilter{Dedupe: tt.dedupe}, 1000, tt.concurrency)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(totals) != len(tt.wantPRs) {
+				t.Errorf("authors = %d, want %d", len(totals), len(tt.wantPRs))
+			}
+			for login, want := range tt.wantPRs {
+				a := totals[login]
+				if a == nil {
+					t.Fatalf("%s missing", login)
+				}
+				if a.PRs != want || a.Additions != tt.wantAdds[login] {
+					t.Errorf("%s: prs=%d additions=%d, want prs=%d additions=%d", login, a.PRs, a.Additions, want, tt.wantAdds[login])
+				}
+			}
+			// 各ブランチは 1 回だけ取得する
+			reqs := f.requests()
+			if len(reqs) != tt.wantReqs {
+				t.Errorf("requests = %d, want %d", len(reqs), tt.wantReqs)
+			}
+			seen := map[interface{}]bool{}
+			for _, r := range reqs {
+				if seen[r.Variables["base"]] {
+					t.Errorf("base %v fetched twice", r.Variables["base"])
+				}
+				seen[r.Variables["base"]] = true
+			}
+		})
+	}
+}
+
+func TestFetchRepoPRAggHalvesPageOnTimeout(t *testing.T) {
+	quietGlobals(t)
+	f, endpoint := newFakeGraphQL(t, func(n int, req graphQLRequest) (int, string) {
+		if n == 1 {
+			return http.StatusOK, `{"data":null,"errors":[{"type":"TIMEOUT","message":"Timeout on validation of query"}]}`
+		}
+		return http.StatusOK, prPage(prJSON(1, "alice", 10, 5))
+	})
+	totals, err := fetchRepoPRAgg(context.Background(), endpoint, "tok", "acme", "r1", []string{"main"}, prFilter{}, 1000, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a := totals["alice"]; a == nil || a.PRs != 1 {
+		t.Errorf("alice = %+v, want 1 PR", a)
+	}
+	reqs := f.requests()
+	if len(reqs) != 2 {
+		t.Fatalf("requests = %d, want 2", len(reqs))
+	}
+	if first, second := reqs[0].Variables["first"], reqs[1].Variables["first"]; first != float64(100) || second != float64(50) {
+		t.Errorf("page sizes = %v, %v; want 100, 50", first, second)
+	}
+	if reqs[1].Variables["cursor"] != reqs[0].Variables["cursor"] {
+		t.Errorf("retry changed the cursor: %v -> %v", reqs[0].Variables["cursor"], reqs[1].Variables["cursor"])
+	}
+}
+
+func TestFetchRepoPRAggForbidden(t *testing.T) {
+	quietGlobals(t)
+	_, endpoint := newFakeGraphQL(t, func(int, graphQLRequest) (int, string) {
+		return http.StatusOK, `{"data":{"repository":{"pullRequests":null}},"errors":[{"type":"FORBIDDEN","message":"Resource not accessible by integration"}]}`
+	})
+	_, err := fetchRepoPRAgg(context.Background(), endpoint, "tok", "acme", "secret", []string{"main"}, prFilter{}, 1000, 1)
+	if !errors.Is(err, errNoPRAccess) {
+		t.Errorf("err = %v, want errNoPRAccess", err)
+	}
+}
+
+func TestMustParseUntilOrZero(t *testing.T) {
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		in   string
+		loc  *time.Location
+		want time.Time
+	}{
+		{"empty", "", time.UTC, time.Time{}},
+		{"date only covers the whole day", "2024-03-31", time.UTC, time.Date(2024, 3, 31, 23, 59, 59, 999999999, time.UTC)},
+		{"date only in --timezone", "2024-03-31", tokyo, time.Date(2024, 3, 31, 23, 59, 59, 999999999, tokyo)},
+		{"timestamp is verbatim", "2024-03-31T12:00:00Z", time.UTC, time.Date(2024, 3, 31, 12, 0, 0, 0, time.UTC)},
+		{"timestamp with offset is verbatim", "2024-03-31T00:00:00+09:00", time.UTC, time.Date(2024, 3, 30, 15, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			saved := reportLoc
+			reportLoc = tt.loc
+			defer func() { reportLoc = saved }()
+			got := mustParseUntilOrZero(tt.in)
+			if !got.Equal(tt.want) {
+				t.Errorf("mustParseUntilOrZero(%q) = %s, want %s", tt.in, got, tt.want)
+			}
+		})
+	}
+	// 日付だけの --until はその日の最後の PR を含み、翌日 0:00 は含まない
+	until := mustParseUntilOrZero("2024-03-31")
+	if !inRange(time.Date(2024, 3, 31, 23, 59, 59, 0, time.UTC), time.Time{}, until) {
+		t.Error("last second of the day excluded")
+	}
+	if inRange(time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC), time.Time{}, until) {
+		t.Error("next day included")
+	}
+}
+
+func TestGhostAndUnknownAuthors(t *testing.T) {
+	const fixture = `[
+  {"number":1,"state":"MERGED","mergedAt":"2024-01-02T00:00:00Z","additions":7,"deletions":1,"author":null},
+  {"number":2,"state":"MERGED","mergedAt":"2024-01-03T00:00:00Z","additions":4,"deletions":0,"author":{"login":""}},
+  {"number":3,"state":"MERGED","mergedAt":"2024-01-04T00:00:00Z","additions":2,"deletions":2,"author":{"login":"alice"}}
+]`
+	var nodes []prNode
+	if err := json.Unmarshal([]byte(fixture), &nodes); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		drop bool
+		want map[string]int // login -> additions
+	}{
+		{"bucketed", false, map[string]int{ghostLogin: 7, unknownLogin: 4, "alice": 2}},
+		{"--drop-unknown-authors", true, map[string]int{"alice": 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			totals := map[string]*agg{}
+			for _, n := range nodes {
+				accumulatePR(totals, "acme", "r1", n, prFilter{DropUnknownAuthors: tt.drop}, generatedRules{})
+			}
+			if len(totals) != len(tt.want) {
+				t.Errorf("logins = %v, want %v", keysOf(totals), tt.want)
+			}
+			for login, adds := range tt.want {
+				if a := totals[login]; a == nil || a.Additions != adds || a.PRs != 1 {
+					t.Errorf("%s = %+v, want 1 PR with %d additions", login, a, adds)
+				}
+			}
+		})
+	}
+}
+
+func keysOf(m map[string]*agg) []string {
+	var ks []string
+	for k := range m {
+		ks = append(ks, k)
+	}
+	return ks
+}
+
+func TestCountWeeksAcrossDST(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := reportLoc
+	reportLoc = ny
+	defer func() { reportLoc = saved }()
+	tests := []struct {
+		from, to string
+		want     int
+	}{
+		{"2024-03-05", "2024-03-05", 1},
+		{"2024-03-05", "2024-03-12", 2}, // 2024-03-10 に夏時間開始 (167h の週)
+		{"2024-10-29", "2024-11-05", 2}, // 2024-11-03 に夏時間終了 (169h の週)
+		{"2024-01-01", "2024-12-31", 53},
+		{"2024-03-12", "2024-03-05", 0},
+	}
+	for _, tt := range tests {
+		from, _ := time.ParseInLocation("2006-01-02", tt.from, ny)
+		to, _ := time.ParseInLocation("2006-01-02", tt.to, ny)
+		if got := countWeeks(from, to); got != tt.want {
+			t.Errorf("countWeeks(%s, %s) = %d, want %d", tt.from, tt.to, got, tt.want)
+		}
+	}
+	// 週のキーは reportLoc で読み戻せば同じ週の月曜になる
+	key := weekStart(time.Date(2024, 3, 6, 12, 0, 0, 0, ny)).Format("2006-01-02")
+	back, _ := time.ParseInLocation("2006-01-02", key, ny)
+	if got := weekStart(back).Format("2006-01-02"); got != key {
+		t.Errorf("week key %s re-parsed as week %s", key, got)
+	}
+}
+
+func TestBucketScore(t *testing.T) {
+	tests := []struct{ score, n, want int }{
+		{1299, 100, 1200},
+		{1300, 100, 1300},
+		{-1299, 100, -1300},
+		{-1300, 100, -1300},
+		{-1, 100, -100},
+		{0, 100, 0},
+		{1299, 0, 1299},
+	}
+	for _, tt := range tests {
+		if got := bucketScore(tt.score, tt.n); got != tt.want {
+			t.Errorf("bucketScore(%d, %d) = %d, want %d", tt.score, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestLimitPerRepoPerPeriod(t *testing.T) {
+	rows := []row{
+		{Org: "acme", Repo: "r1", User: "alice", Period: "2024-01", Score: 30},
+		{Org: "acme", Repo: "r1", User: "bob", Period: "2024-01", Score: 20},
+		{Org: "acme", Repo: "r1", User: "alice", Period: "2024-02", Score: 5},
+		{Org: "acme", Repo: "r1", User: "bob", Period: "2024-02", Score: 10},
+		{Org: "acme", Repo: "r2", User: "carol", Period: "2024-01", Score: 1},
+	}
+	var got []string
+	for _, r := range limitPerRepo(rows, 1) {
+		got = append(got, r.Repo+"/"+r.Period+"/"+r.User)
+	}
+	want := []string{"r1/2024-01/alice", "r1/2024-02/bob", "r2/2024-01/carol"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("limitPerRepo = %v, want %v", got, want)
+	}
+}
+
+// 1 回の Write が 1 行になっているかを数える
+type writeCounter struct {
+	mu     sync.Mutex
+	writes []string
+}
+
+func (w *writeCounter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.writes = append(w.writes, string(p))
+	return len(p), nil
+}
+
+func TestExplainPRWritesWholeLines(t *testing.T) {
+	w := &writeCounter{}
+	saved := explainOut
+	explainOut = w
+	defer func() { explainOut = saved }()
+	var nodes []prNode
+	if err := json.Unmarshal([]byte(`[`+prJSON(1, "alice", 10, 5)+`]`), &nodes); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			explainPR("acme", "r1", nodes[0], "skipped", "bot author")
+		}()
+	}
+	wg.Wait()
+	if len(w.writes) != 50 {
+		t.Fatalf("writes = %d, want 50 (one per line)", len(w.writes))
+	}
+	for _, s := range w.writes {
+		if s != "EXPLAIN acme/r1#1 base=main author=alice +10/-5: skipped (bot author)\n" {
+			t.Errorf("line = %q", s)
+		}
+	}
+}
+
+func TestFetchRepoPRAggGitattributesErrors(t *testing.T) {
+	tests := []struct {
+		name, errType string
+		want          error
+	}{
+		{"forbidden", "FORBIDDEN", errNoPRAccess},
+		{"not found", "NOT_FOUND", errRepoNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			quietGlobals(t)
+			f, endpoint := newFakeGraphQL(t, func(int, graphQLRequest) (int, string) {
+				return http.StatusOK, `{"data":{"repository":null},"errors":[{"type":"` + tt.errType + `","message":"nope"}]}`
+			})
+			_, err := fetchRepoPRAgg(context.Background(), endpoint, "tok", "acme", "secret", []string{"main"}, prFilter{RespectGitattributes: true}, 1000, 1)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("err = %v, want %v", err, tt.want)
+			}
+			if reqs := f.requests(); len(reqs) != 1 || operationName(reqs[0].Query) != "Gitattributes" {
+				t.Errorf("requests = %d, want only the .gitattributes query", len(reqs))
+			}
+		})
+	}
+}
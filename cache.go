@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// --cache-dir。nil ならキャッシュしない
+var gqlCache *responseCache
+
+// GraphQL のレスポンス本文をリクエストのハッシュをファイル名にして保存する。出力の調整で同じスキャンを
+// 繰り返すとき用で、期限内は API の更新を反映しない
+type responseCache struct {
+	Dir string
+	TTL time.Duration // 0 なら期限なし
+}
+
+// エンドポイント・トークン・リクエスト本文 (クエリ + 変数) のハッシュ。変数の map は json.Marshal がキー順に並べる。
+// トークンごとに見えるデータが違うので鍵に含める (ファイルには残らない)
+func (c *responseCache) key(endpoint, token string, body []byte) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n", endpoint, token)
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (c *responseCache) path(key string) string {
+	return filepath.Join(c.Dir, key+".json")
+}
+
+// 期限内のキャッシュがあれば本文を返す
+func (c *responseCache) get(key string) ([]byte, bool) {
+	p := c.path(key)
+	st, err := os.Stat(p)
+	if err != nil {
+		return nil, false
+	}
+	if c.TTL > 0 && time.Since(st.ModTime()) > c.TTL {
+		return nil, false
+	}
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return nil, false
+	}
+	return b, true
+}
+
+// GraphQL の errors を含むレスポンスは保存しない (一時的な失敗を固定しない)。書き込みに失敗しても実行は続ける
+func (c *responseCache) put(key string, b []byte) {
+	var probe struct {
+		Errors []json.RawMessage `json:"errors"`
+	}
+	if json.Unmarshal(b, &probe) != nil || len(probe.Errors) > 0 {
+		return
+	}
+	f, err := createAtomic(c.path(key))
+	if err != nil {
+		warnf("--cache-dir: %v\n", err)
+		return
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Abort()
+		warnf("--cache-dir: %v\n", err)
+		return
+	}
+	if err := f.Commit(); err != nil {
+		warnf("--cache-dir: %v\n", err)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// --config の JSON。キーはフラグ名 ("max-repos" / "max_repos" のどちらでも可)、値は文字列・数値・真偽値、
+// カンマ区切りを受けるフラグには文字列の配列も書ける
+type configOptions map[string]json.RawMessage
+
+func loadConfig(path string) (configOptions, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var opts configOptions
+	if err := json.Unmarshal(b, &opts); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return opts, nil
+}
+
+// コマンドラインで明示されていないフラグに設定ファイルの値を入れる。未知のキーは無視して返す
+// (設定ファイルで --log-level / --quiet が決まってから警告するため)
+func (c configOptions) apply(fs *flag.FlagSet) (unknown []string, err error) {
+	explicit := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		name := strings.ReplaceAll(key, "_", "-")
+		if name == "config" || fs.Lookup(name) == nil {
+			unknown = append(unknown, key)
+			continue
+		}
+		if explicit[name] {
+			continue
+		}
+		v, err := configValue(c[key])
+		if err != nil {
+			return unknown, fmt.Errorf("key %q: %w", key, err)
+		}
+		if err := fs.Set(name, v); err != nil {
+			return unknown, fmt.Errorf("key %q: %w", key, err)
+		}
+	}
+	return unknown, nil
+}
+
+// JSON の値をフラグに渡す文字列にする。配列はカンマで連結する
+func configValue(raw json.RawMessage) (string, error) {
+	raw = bytes.TrimSpace(raw)
+	switch {
+	case len(raw) > 0 && raw[0] == '"':
+		var s string
+		err := json.Unmarshal(raw, &s)
+		return s, err
+	case len(raw) > 0 && raw[0] == '[':
+		var items []json.RawMessage
+		if err := json.Unmarshal(raw, &items); err != nil {
+			return "", err
+		}
+		parts := make([]string, len(items))
+		for i, item := range items {
+			v, err := configValue(item)
+			if err != nil {
+				return "", err
+			}
+			parts[i] = v
+		}
+		return strings.Join(parts, ","), nil
+	case len(raw) > 0 && (raw[0] == '{' || string(raw) == "null"):
+		return "", fmt.Errorf("unsupported value %s", raw)
+	}
+	// 数値・真偽値はリテラルのまま
+	return string(raw), nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"reflect"
+	"testing"
+)
+
+func TestConfigApplyReturnsUnknownKeys(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	maxRepos := fs.Int("max-repos", 0, "")
+	orgs := fs.String("org", "", "")
+	fs.String("config", "", "")
+	if err := fs.Parse([]string{"--org", "cli-org"}); err != nil {
+		t.Fatal(err)
+	}
+	var cfg configOptions
+	if err := json.Unmarshal([]byte(`{"max_repos": 5, "org": "file-org", "bogus": 1, "config": "x.json"}`), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	unknown, err := cfg.apply(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"bogus", "config"}; !reflect.DeepEqual(unknown, want) {
+		t.Errorf("unknown = %v, want %v", unknown, want)
+	}
+	if *maxRepos != 5 || *orgs != "cli-org" {
+		t.Errorf("max-repos = %d, org = %q; want 5, cli-org", *maxRepos, *orgs)
+	}
+}
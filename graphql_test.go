@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// テスト中は再試行の待ちを短くし、WARN などを stderr に出さない
+func quietGlobals(t *testing.T) {
+	t.Helper()
+	savedBackoff, savedLevel, savedClient := retryBackoff, stderrLevel, httpClient
+	retryBackoff = backoff{Attempts: 5, Base: time.Millisecond, Max: 5 * time.Millisecond}
+	stderrLevel = levelError
+	t.Cleanup(func() {
+		retryBackoff, stderrLevel, httpClient = savedBackoff, savedLevel, savedClient
+	})
+}
+
+// httptest の GraphQL サーバー。handle は n 回目 (1 始まり) のリクエストごとにステータスと本文を返す
+type fakeGraphQL struct {
+	mu     sync.Mutex
+	reqs   []graphQLRequest
+	handle func(n int, req graphQLRequest) (int, string)
+}
+
+func newFakeGraphQL(t *testing.T, handle func(n int, req graphQLRequest) (int, string)) (*fakeGraphQL, string) {
+	t.Helper()
+	f := &fakeGraphQL{handle: handle}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req graphQLRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.mu.Lock()
+		f.reqs = append(f.reqs, req)
+		n := len(f.reqs)
+		f.mu.Unlock()
+		status, body := f.handle(n, req)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		io.WriteString(w, body)
+	}))
+	t.Cleanup(srv.Close)
+	return f, srv.URL + "/graphql"
+}
+
+func (f *fakeGraphQL) requests() []graphQLRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]graphQLRequest(nil), f.reqs...)
+}
+
+// httpClient を差し替えると doGraphQL はそれを通して送る
+type doerFunc func(*http.Request) (*http.Response, error)
+
+func (f doerFunc) Do(r *http.Request) (*http.Response, error) { return f(r) }
+
+func TestDoGraphQLUsesInjectedClient(t *testing.T) {
+	quietGlobals(t)
+	var got *http.Request
+	httpClient = doerFunc(func(r *http.Request) (*http.Response, error) {
+		got = r
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{},
+			Body:       io.NopCloser(strings.NewReader(`{"data":{}}`)),
+		}, nil
+	})
+	b, err := doGraphQL(context.Background(), "https://ghe.example.com/api/graphql", "tok", `query OwnerType { viewer { login } }`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, []byte(`{"data":{}}`)) {
+		t.Errorf("body = %s", b)
+	}
+	if got == nil {
+		t.Fatal("injected client was not used")
+	}
+	if got.URL.String() != "https://ghe.example.com/api/graphql" {
+		t.Errorf("url = %s", got.URL)
+	}
+	if h := got.Header.Get("Authorization"); h != "Bearer tok" {
+		t.Errorf("Authorization = %q", h)
+	}
+}
+
+func TestDoGraphQLAgainstHTTPTestServer(t *testing.T) {
+	quietGlobals(t)
+	f, endpoint := newFakeGraphQL(t, func(int, graphQLRequest) (int, string) {
+		return http.StatusOK, `{"data":{"viewer":{"login":"octocat"}}}`
+	})
+	b, err := doGraphQL(context.Background(), endpoint, "tok", `query Viewer($x:Int) { viewer { login } }`, map[string]interface{}{"x": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "octocat") {
+		t.Errorf("body = %s", b)
+	}
+	reqs := f.requests()
+	if len(reqs) != 1 || reqs[0].Variables["x"] != float64(1) {
+		t.Errorf("requests = %+v", reqs)
+	}
+}
+
+func TestDoGraphQLRetriesServerErrors(t *testing.T) {
+	quietGlobals(t)
+	f, endpoint := newFakeGraphQL(t, func(n int, _ graphQLRequest) (int, string) {
+		if n < 3 {
+			return http.StatusInternalServerError, `{"message":"boom"}`
+		}
+		return http.StatusOK, `{"data":{"repositoryOwner":{"__typename":"Organization"}}}`
+	})
+	got, err := resolveOwnerType(context.Background(), endpoint, "tok", "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "org" {
+		t.Errorf("owner type = %q, want org", got)
+	}
+	if n := len(f.requests()); n != 3 {
+		t.Errorf("attempts = %d, want 3", n)
+	}
+}
+
+func TestDoGraphQLGivesUpAfterAttempts(t *testing.T) {
+	quietGlobals(t)
+	retryBackoff.Attempts = 2
+	f, endpoint := newFakeGraphQL(t, func(int, graphQLRequest) (int, string) {
+		return http.StatusBadGateway, `bad gateway`
+	})
+	_, err := doGraphQL(context.Background(), endpoint, "tok", `query OwnerType { viewer { login } }`, nil)
+	if err == nil || !strings.Contains(err.Error(), "http 502") {
+		t.Errorf("err = %v, want http 502", err)
+	}
+	if n := len(f.requests()); n != 2 {
+		t.Errorf("attempts = %d, want 2", n)
+	}
+}
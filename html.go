@@ -0,0 +1,136 @@
+package main
+
+import (
+	"html/template"
+	"io"
+	"time"
+)
+
+// --format html の見出しや openmetrics の HELP に出すスキャン条件
+type reportMeta struct {
+	Org    string
+	Since  time.Time
+	Until  time.Time
+	Repos  int
+	States []string
+}
+
+// 外部ファイルを読まない1ファイルの HTML。ログインやリポジトリ名は html/template がエスケープする。
+// ヘッダーのクリックで昇順/降順を切り替える (数値列は data-v の数値で比べる)
+var htmlReport = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>PR lines by author: {{.Meta.Org}}</title>
+<style>
+body { font-family: -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; margin: 2em; color: #1f2328; }
+h1 { font-size: 1.4em; margin-bottom: 0.2em; }
+.meta { color: #59636e; margin-bottom: 1.2em; }
+table { border-collapse: collapse; font-size: 0.9em; }
+th, td { border: 1px solid #d1d9e0; padding: 4px 10px; }
+th { background: #f6f8fa; cursor: pointer; user-select: none; white-space: nowrap; }
+th.asc::after { content: " \25B2"; }
+th.desc::after { content: " \25BC"; }
+tbody tr:nth-child(even) { background: #f6f8fa; }
+td.num { text-align: right; font-variant-numeric: tabular-nums; }
+td.score { font-weight: bold; background: #fff8c5; }
+tfoot td { font-weight: bold; border-top: 2px solid #59636e; }
+</style>
+</head>
+<body>
+<h1>PR lines by author: {{.Meta.Org}}</h1>
+<div class="meta">{{.Since}} &ndash; {{.Until}} &middot; {{.Meta.Repos}} repos &middot; {{len .Rows}} rows &middot; generated {{.GeneratedAt}}</div>
+<table id="report">
+<thead><tr>{{range .Header}}<th>{{.}}</th>{{end}}</tr></thead>
+<tbody>
+{{- range .Rows}}
+<tr>{{range .}}<td{{if .Class}} class="{{.Class}}"{{end}}{{if .Num}} data-v="{{.Text}}"{{end}}>{{.Text}}</td>{{end}}</tr>
+{{- end}}
+</tbody>
+{{- with .Total}}
+<tfoot><tr>{{range .}}<td{{if .Class}} class="{{.Class}}"{{end}}>{{.Text}}</td>{{end}}</tr></tfoot>
+{{- end}}
+</table>
+<script>
+(function () {
+  var table = document.getElementById("report");
+  var heads = table.tHead.rows[0].cells;
+  Array.prototype.forEach.call(heads, function (th, col) {
+    th.addEventListener("click", function () {
+      var desc = !th.classList.contains("desc");
+      Array.prototype.forEach.call(heads, function (h) { h.classList.remove("asc", "desc"); });
+      th.classList.add(desc ? "desc" : "asc");
+      var body = table.tBodies[0];
+      var rows = Array.prototype.slice.call(body.rows);
+      rows.sort(function (a, b) {
+        var x = a.cells[col], y = b.cells[col], c;
+        if (x.hasAttribute("data-v") && y.hasAttribute("data-v")) {
+          c = parseFloat(x.getAttribute("data-v")) - parseFloat(y.getAttribute("data-v"));
+        } else {
+          c = x.textContent.localeCompare(y.textContent);
+        }
+        return desc ? -c : c;
+      });
+      rows.forEach(function (r) { body.appendChild(r); });
+    });
+  });
+})();
+</script>
+</body>
+</html>
+`))
+
+type htmlCell struct {
+	Text  string
+	Class string // num / num score
+	Num   bool
+}
+
+func writeHTML(w io.Writer, rows []row, opts outputOptions, generatedAt time.Time) error {
+	cols := columnsFor(opts)
+	numeric := make([]bool, len(cols))
+	header := make([]string, len(cols))
+	for i, c := range cols {
+		header[i] = c.Name
+		numeric[i] = numericColumn(c, rows)
+	}
+	cells := func(values []string, sortable bool) []htmlCell {
+		out := make([]htmlCell, len(cols))
+		for i, v := range values {
+			out[i].Text = v
+			if numeric[i] {
+				out[i].Class = "num"
+				out[i].Num = sortable && v != ""
+			}
+			if cols[i].Name == "score" {
+				out[i].Class += " score"
+			}
+		}
+		return out
+	}
+	data := struct {
+		Meta         reportMeta
+		Since, Until string
+		GeneratedAt  string
+		Header       []string
+		Rows         [][]htmlCell
+		Total        []htmlCell
+	}{
+		Meta:        opts.Meta,
+		Since:       fmtBound(opts.Meta.Since),
+		Until:       fmtBound(opts.Meta.Until),
+		GeneratedAt: generatedAt.UTC().Format(time.RFC3339),
+		Header:      header,
+	}
+	for _, r := range rows {
+		values := make([]string, len(cols))
+		for i, c := range cols {
+			values[i] = formatCell(c.Value(r))
+		}
+		data.Rows = append(data.Rows, cells(values, true))
+	}
+	if t := opts.GrandTotal; t != nil {
+		data.Total = cells(grandTotalRecord(cols, *t), false)
+	}
+	return htmlReport.Execute(w, data)
+}
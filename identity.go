@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+type userEmailResp struct {
+	Data struct {
+		User *struct {
+			Email string `json:"email"`
+		} `json:"user"`
+	} `json:"data"`
+	Errors []gqlError `json:"errors"`
+}
+
+// 公開プロフィールのメール。非公開・bot・削除済みユーザーは空
+func fetchUserEmail(ctx context.Context, endpoint, token, login string) (string, error) {
+	const q = `query UserEmail($login:String!) { user(login:$login) { email } }`
+	b, err := doGraphQL(ctx, endpoint, token, q, map[string]interface{}{"login": login})
+	if err != nil {
+		return "", err
+	}
+	var out userEmailResp
+	if err := json.Unmarshal(b, &out); err != nil {
+		return "", err
+	}
+	if len(out.Errors) > 0 {
+		return "", joinGQLErrors(out.Errors)
+	}
+	if out.Data.User == nil {
+		return "", nil
+	}
+	return strings.ToLower(strings.TrimSpace(out.Data.User.Email)), nil
+}
+
+// 公開メールが同じ login 同士を1つの canonical login にまとめる対応表 (login -> canonical) を作る。
+// canonical は全repo合算の score が最大のもの（同点は login 昇順）。
+func resolveEmailIdentities(ctx context.Context, endpoint, token string, repoAggs map[repoRef]map[string]*agg) map[string]string {
+	scores := map[string]int{}
+	for _, m := range repoAggs {
+		for login, a := range m {
+			scores[login] += scoreOf(a.Additions, a.Deletions)
+		}
+	}
+	byEmail := map[string][]string{}
+	for login := range scores {
+		if strings.HasPrefix(login, "(") {
+			continue // (unknown) など
+		}
+		if ctx.Err() != nil {
+			warnf("stopped resolving emails: %v\n", ctx.Err())
+			break
+		}
+		email, err := fetchUserEmail(ctx, endpoint, token, login)
+		if err != nil {
+			warnf("cannot fetch email for %s: %v\n", login, err)
+			continue
+		}
+		if email != "" {
+			byEmail[email] = append(byEmail[email], login)
+		}
+	}
+	canon := map[string]string{}
+	for _, logins := range byEmail {
+		if len(logins) < 2 {
+			continue
+		}
+		sort.Slice(logins, func(i, j int) bool {
+			if scores[logins[i]] == scores[logins[j]] {
+				return logins[i] < logins[j]
+			}
+			return scores[logins[i]] > scores[logins[j]]
+		})
+		for _, l := range logins[1:] {
+			canon[l] = logins[0]
+		}
+		infof("Merged logins by email: %s -> %s\n", strings.Join(logins[1:], ", "), logins[0])
+	}
+	return canon
+}
+
+// canon に従って login を付け替え、同じ canonical になったものを合算する
+func remapLogins(m map[string]*agg, canon map[string]string) map[string]*agg {
+	if len(canon) == 0 {
+		return m
+	}
+	out := map[string]*agg{}
+	for login, a := range m {
+		if c, ok := canon[login]; ok {
+			login = c
+		}
+		t := out[login]
+		if t == nil {
+			t = &agg{}
+			out[login] = t
+		}
+		t.merge(a)
+	}
+	return out
+}
+
+// --identity-map の 1 行。Team は空でもよい
+type identity struct {
+	Name string `json:"name"`
+	Team string `json:"team"`
+}
+
+// login (小文字) -> 表示名・チーム。引けなかった login は missing に記録して件数を警告する
+type identityMap struct {
+	entries  map[string]identity
+	hasTeams bool
+	missing  map[string]bool
+}
+
+// CSV (login,name[,team]。先頭行が login で始まればヘッダーとして読み飛ばす。# はコメント) か、
+// 拡張子が .json なら {"login": {"name": "...", "team": "..."}} を読む
+func loadIdentityMap(path string) (*identityMap, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m := &identityMap{entries: map[string]identity{}, missing: map[string]bool{}}
+	add := func(login string, id identity) {
+		id.Name, id.Team = strings.TrimSpace(id.Name), strings.TrimSpace(id.Team)
+		m.entries[strings.ToLower(strings.TrimSpace(login))] = id
+		if id.Team != "" {
+			m.hasTeams = true
+		}
+	}
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		var raw map[string]identity
+		if err := json.Unmarshal(b, &raw); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		for login, id := range raw {
+			add(login, id)
+		}
+		return m, nil
+	}
+	r := csv.NewReader(bytes.NewReader(b))
+	r.Comment = '#'
+	r.FieldsPerRecord = -1
+	recs, err := r.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for i, rec := range recs {
+		if i == 0 && strings.EqualFold(strings.TrimSpace(rec[0]), "login") {
+			continue
+		}
+		if len(rec) < 2 {
+			return nil, fmt.Errorf("%s: line %d: want login,name[,team]", path, i+1)
+		}
+		id := identity{Name: rec[1]}
+		if len(rec) > 2 {
+			id.Team = rec[2]
+		}
+		add(rec[0], id)
+	}
+	return m, nil
+}
+
+func (m *identityMap) lookup(login string) (identity, bool) {
+	id, ok := m.entries[strings.ToLower(login)]
+	if !ok && !strings.HasPrefix(login, "(") { // (unknown) などは数えない
+		m.missing[login] = true
+	}
+	return id, ok
+}
+
+// 表示名。未登録・空なら login のまま
+func (m *identityMap) nameOf(login string) string {
+	if id, ok := m.lookup(login); ok && id.Name != "" {
+		return id.Name
+	}
+	return login
+}
+
+func (m *identityMap) teamOf(login string) string {
+	id, _ := m.lookup(login)
+	return id.Team
+}
+
+// --group-by team 用の login -> チーム の対応表 (remapLogins に渡す)。チームがない login は login のまま残す
+func (m *identityMap) teamCanon(logins map[string]*agg) map[string]string {
+	canon := map[string]string{}
+	for login := range logins {
+		if t := m.teamOf(login); t != "" {
+			canon[login] = t
+		}
+	}
+	return canon
+}
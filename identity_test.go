@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestFetchUserEmail(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    string
+		wantErr bool
+	}{
+		{"public email", `{"data":{"user":{"email":" Alice@Example.com "}}}`, "alice@example.com", false},
+		{"private email", `{"data":{"user":{"email":""}}}`, "", false},
+		{"graphql error", `{"data":{"user":null},"errors":[{"type":"NOT_FOUND","message":"Could not resolve to a User with the login of 'ghost'."}]}`, "", true},
+		{"missing scope", `{"data":{"user":{"email":""}},"errors":[{"type":"INSUFFICIENT_SCOPES","message":"Your token has not been granted the required scopes"}]}`, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			quietGlobals(t)
+			_, endpoint := newFakeGraphQL(t, func(int, graphQLRequest) (int, string) {
+				return http.StatusOK, tt.body
+			})
+			got, err := fetchUserEmail(context.Background(), endpoint, "tok", "alice")
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("fetchUserEmail = %q, %v; want %q, error %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// stderr に出すメッセージの詳細度。ERROR は常に出す
+type logLevel int
+
+const (
+	levelError logLevel = iota // --quiet
+	levelWarn
+	levelInfo  // 既定。要約や件数などの情報も出す
+	levelDebug // GraphQL リクエストごとのログも出す
+)
+
+// --log-level error|warn|info|debug
+func parseLogLevel(s string) (logLevel, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "error":
+		return levelError, nil
+	case "warn":
+		return levelWarn, nil
+	case "info":
+		return levelInfo, nil
+	case "debug":
+		return levelDebug, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q (error|warn|info|debug)", s)
+}
+
+var stderrLevel = levelInfo
+
+// "WARN: " を付けて stderr に書く。format は改行まで含める
+func warnf(format string, args ...interface{}) {
+	if stderrLevel >= levelWarn {
+		fmt.Fprintf(os.Stderr, "WARN: "+format, args...)
+	}
+}
+
+// "DEBUG: " を付けて stderr に書く
+func debugf(format string, args ...interface{}) {
+	if stderrLevel >= levelDebug {
+		fmt.Fprintf(os.Stderr, "DEBUG: "+format, args...)
+	}
+}
+
+// 要約・件数などの情報をそのまま stderr に書く
+func infof(format string, args ...interface{}) {
+	if stderrLevel >= levelInfo {
+		fmt.Fprintf(os.Stderr, format, args...)
+	}
+}
@@ -0,0 +1,876 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 書き込み中は path と同じディレクトリの一時ファイルに書き、Commit で rename する
+type atomicFile struct {
+	*os.File
+	path string
+	done bool
+}
+
+func createAtomic(path string) (*atomicFile, error) {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return nil, err
+	}
+	return &atomicFile{File: f, path: path}, nil
+}
+
+func (a *atomicFile) Commit() error {
+	if a.done {
+		return nil
+	}
+	a.done = true
+	if err := a.File.Sync(); err != nil {
+		a.File.Close()
+		os.Remove(a.File.Name())
+		return err
+	}
+	if err := a.File.Close(); err != nil {
+		os.Remove(a.File.Name())
+		return err
+	}
+	// CreateTemp は 0600 で作るので os.Create 相当の権限に揃える
+	if err := os.Chmod(a.File.Name(), 0o644); err != nil {
+		os.Remove(a.File.Name())
+		return err
+	}
+	return os.Rename(a.File.Name(), a.path)
+}
+
+// Commit 前なら一時ファイルを破棄する。Commit 後は何もしない
+func (a *atomicFile) Abort() {
+	if a.done {
+		return
+	}
+	a.done = true
+	a.File.Close()
+	os.Remove(a.File.Name())
+}
+
+// 出力列のオン/オフ
+type outputOptions struct {
+	WithRepoGroup bool
+	// repo, user の代わりに team 列を出す (--by-team)
+	ByTeam bool
+	// deletions の後に net (additions - deletions) を出す (--with-net)。既定の列位置を変えないよう明示したときだけ
+	WithNet bool
+	// name, team (--identity-map)
+	WithName      bool
+	WithTeam      bool
+	WithScore     bool
+	WithMilestone bool
+	// files (changedFiles の合計)
+	WithFiles bool
+	// period (--bucket)
+	WithPeriod bool
+	// active_weeks, consistency
+	WithConsistency bool
+	// avg_lead_time_hours, median_lead_time_hours
+	WithLeadTime bool
+	// median_pr_size, p90_pr_size, max_pr_size
+	WithPRSize bool
+	// weekday_prs, weekend_prs
+	WithWeekendSplit bool
+	// empty_prs
+	WithEmptyPRs bool
+	// approved_prs, changes_requested_prs, review_required_prs, no_decision_prs
+	WithReviewDecision bool
+	// approved_reviews, changes_requested_reviews, commented_reviews (--include-reviews)
+	WithReviews bool
+	// first_merged, last_merged
+	WithDates bool
+	// additions_pctl, deletions_pctl, score_pctl (org 合算での順位)
+	PercentileRanks bool
+	// additions / deletions / net / score の実数列を出さない (PercentileRanks と併用)
+	HideRawCounts bool
+	// nil でなければ最終行に repo=TOTAL, user=ALL の合計行を書く
+	GrandTotal *row
+	// CSV の末尾に "# " を付けて書く行 (スキャンの出所情報)
+	Footer []string
+	// --format html の見出し
+	Meta reportMeta
+}
+
+// 出力列。Value は int / string / fixed / nil (空欄, JSON では null) を返す
+type column struct {
+	Name  string
+	Value func(r row) interface{}
+}
+
+// 小数点以下 prec 桁で表示する数値
+type fixed struct {
+	v    float64
+	prec int
+}
+
+func (f fixed) String() string               { return strconv.FormatFloat(f.v, 'f', f.prec, 64) }
+func (f fixed) MarshalJSON() ([]byte, error) { return []byte(f.String()), nil }
+
+func formatCell(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return ""
+	case int:
+		return fmt.Sprintf("%d", x)
+	case string:
+		return x
+	case fixed:
+		return x.String()
+	}
+	return fmt.Sprint(v)
+}
+
+// opts で有効な列を CSV と同じ順序で返す
+func columnsFor(opts outputOptions) []column {
+	cols := []column{
+		{"org", func(r row) interface{} { return r.Org }},
+	}
+	if opts.ByTeam {
+		cols = append(cols, column{"team", func(r row) interface{} { return r.Team }})
+	} else {
+		cols = append(cols, column{"repo", func(r row) interface{} { return r.Repo }})
+		if opts.WithRepoGroup {
+			cols = append(cols, column{"repo_group", func(r row) interface{} { return r.RepoGroup }})
+		}
+		cols = append(cols, column{"user", func(r row) interface{} { return r.User }})
+	}
+	if opts.WithName {
+		cols = append(cols, column{"name", func(r row) interface{} { return r.Name }})
+	}
+	if opts.WithTeam {
+		cols = append(cols, column{"team", func(r row) interface{} { return r.Team }})
+	}
+	if opts.WithPeriod {
+		cols = append(cols, column{"period", func(r row) interface{} { return r.Period }})
+	}
+	if !opts.HideRawCounts {
+		cols = append(cols,
+			column{"additions", func(r row) interface{} { return r.Additions }},
+			column{"deletions", func(r row) interface{} { return r.Deletions }},
+		)
+		if opts.WithNet {
+			cols = append(cols, column{"net", func(r row) interface{} { return r.Net }})
+		}
+	}
+	cols = append(cols, column{"prs", func(r row) interface{} { return r.PRs }})
+	if opts.WithFiles {
+		cols = append(cols, column{"files", func(r row) interface{} { return r.Files }})
+	}
+	if opts.WithScore && !opts.HideRawCounts {
+		cols = append(cols, column{"score", func(r row) interface{} { return r.Score }})
+	}
+	if opts.PercentileRanks {
+		cols = append(cols,
+			column{"additions_pctl", func(r row) interface{} { return r.AdditionsPctl }},
+			column{"deletions_pctl", func(r row) interface{} { return r.DeletionsPctl }},
+			column{"score_pctl", func(r row) interface{} { return r.ScorePctl }},
+		)
+	}
+	if opts.WithMilestone {
+		cols = append(cols, column{"milestone", func(r row) interface{} { return r.Milestone }})
+	}
+	if opts.WithConsistency {
+		cols = append(cols,
+			column{"active_weeks", func(r row) interface{} { return r.ActiveWeeks }},
+			column{"consistency", func(r row) interface{} { return fixed{r.Consistency, 3} }},
+		)
+	}
+	if opts.WithLeadTime {
+		// 計測できた PR がなければ空欄
+		lead := func(v func(r row) float64) func(r row) interface{} {
+			return func(r row) interface{} {
+				if r.LeadSamples == 0 {
+					return nil
+				}
+				return fixed{v(r), 1}
+			}
+		}
+		cols = append(cols,
+			column{"avg_lead_time_hours", lead(func(r row) float64 { return r.AvgLeadHours })},
+			column{"median_lead_time_hours", lead(func(r row) float64 { return r.MedianLeadHours })},
+		)
+	}
+	if opts.WithPRSize {
+		// PR がない行 (--transform-cmd で作られた行など) は空欄
+		size := func(v func(r row) interface{}) func(r row) interface{} {
+			return func(r row) interface{} {
+				if r.PRs == 0 {
+					return nil
+				}
+				return v(r)
+			}
+		}
+		cols = append(cols,
+			column{"median_pr_size", size(func(r row) interface{} { return fixed{r.MedianPRSize, 1} })},
+			column{"p90_pr_size", size(func(r row) interface{} { return r.P90PRSize })},
+			column{"max_pr_size", size(func(r row) interface{} { return r.MaxPRSize })},
+		)
+	}
+	if opts.WithWeekendSplit {
+		cols = append(cols,
+			column{"weekday_prs", func(r row) interface{} { return r.WeekdayPRs }},
+			column{"weekend_prs", func(r row) interface{} { return r.WeekendPRs }},
+		)
+	}
+	if opts.WithEmptyPRs {
+		cols = append(cols, column{"empty_prs", func(r row) interface{} { return r.EmptyPRs }})
+	}
+	if opts.WithReviewDecision {
+		// reviewDecision が null (レビュー必須設定なし等) は no_decision
+		for _, d := range []struct{ name, key string }{
+			{"approved_prs", "APPROVED"},
+			{"changes_requested_prs", "CHANGES_REQUESTED"},
+			{"review_required_prs", "REVIEW_REQUIRED"},
+			{"no_decision_prs", ""},
+		} {
+			key := d.key
+			cols = append(cols, column{d.name, func(r row) interface{} { return r.Decisions[key] }})
+		}
+	}
+	if opts.WithReviews {
+		// レビュアーとして各 state のレビューをした PR の数
+		for _, d := range []struct{ name, key string }{
+			{"approved_reviews", "APPROVED"},
+			{"changes_requested_reviews", "CHANGES_REQUESTED"},
+			{"commented_reviews", "COMMENTED"},
+		} {
+			key := d.key
+			cols = append(cols, column{d.name, func(r row) interface{} { return r.Reviews[key] }})
+		}
+	}
+	if opts.WithDates {
+		cols = append(cols,
+			column{"first_merged", func(r row) interface{} { return fmtRawTime(r.FirstMerged) }},
+			column{"last_merged", func(r row) interface{} { return fmtRawTime(r.LastMerged) }},
+		)
+	}
+	return cols
+}
+
+func writeCSV(w io.Writer, rows []row, opts outputOptions) error {
+	cw := csv.NewWriter(w)
+	cols := columnsFor(opts)
+	header := make([]string, len(cols))
+	for i, c := range cols {
+		header[i] = c.Name
+	}
+	_ = cw.Write(header)
+	for _, r := range rows {
+		rec := make([]string, len(cols))
+		for i, c := range cols {
+			rec[i] = formatCell(c.Value(r))
+		}
+		_ = cw.Write(rec)
+	}
+	if t := opts.GrandTotal; t != nil {
+		_ = cw.Write(grandTotalRecord(cols, *t))
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return err
+	}
+	for _, line := range opts.Footer {
+		if _, err := fmt.Fprintf(w, "# %s\n", line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 合計行では org / repo / user / 件数以外の列は空欄
+func grandTotalRecord(cols []column, t row) []string {
+	rec := make([]string, len(cols))
+	for i, c := range cols {
+		switch c.Name {
+		case "org":
+			rec[i] = t.Org
+		case "repo":
+			rec[i] = "TOTAL"
+		case "user", "team":
+			rec[i] = "ALL"
+		case "additions", "deletions", "net", "prs", "files", "score":
+			rec[i] = formatCell(c.Value(t))
+		}
+	}
+	return rec
+}
+
+// GitHub Flavored Markdown の表。列は CSV と同じで、数値列は右寄せ。フッターは CSV のみ
+func writeMarkdown(w io.Writer, rows []row, opts outputOptions) error {
+	cols := columnsFor(opts)
+	bw := bufio.NewWriter(w)
+	writeLine := func(cells []string) {
+		bw.WriteString("|")
+		for _, c := range cells {
+			bw.WriteString(" " + escapeMarkdownCell(c) + " |")
+		}
+		bw.WriteString("\n")
+	}
+	header := make([]string, len(cols))
+	align := make([]string, len(cols))
+	for i, c := range cols {
+		header[i] = c.Name
+		align[i] = "---"
+		if numericColumn(c, rows) {
+			align[i] = "--:"
+		}
+	}
+	writeLine(header)
+	// 区切り行はエスケープしない
+	bw.WriteString("| " + strings.Join(align, " | ") + " |\n")
+	for _, r := range rows {
+		rec := make([]string, len(cols))
+		for i, c := range cols {
+			rec[i] = formatCell(c.Value(r))
+		}
+		writeLine(rec)
+	}
+	if t := opts.GrandTotal; t != nil {
+		writeLine(grandTotalRecord(cols, *t))
+	}
+	return bw.Flush()
+}
+
+// 値がある行で int / fixed を返す列。行がなければ左寄せ扱い
+func numericColumn(c column, rows []row) bool {
+	for _, r := range rows {
+		switch c.Value(r).(type) {
+		case int, fixed:
+			return true
+		case nil:
+			continue
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+// | はセルの区切りになるのでエスケープし、改行は表が崩れないよう空白にする
+func escapeMarkdownCell(v string) string {
+	return strings.NewReplacer(`\`, `\\`, "|", `\|`, "\r\n", " ", "\n", " ").Replace(v)
+}
+
+// 1 行 = 1 オブジェクト。キーの順序は CSV の列順と同じ
+func marshalRowJSON(r row, cols []column) ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, c := range cols {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		k, _ := json.Marshal(c.Name)
+		v, err := json.Marshal(c.Value(r))
+		if err != nil {
+			return nil, err
+		}
+		b.Write(k)
+		b.WriteByte(':')
+		b.Write(v)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// JSON 配列。score は --with-score に関係なく常に含める
+func writeJSON(w io.Writer, rows []row, opts outputOptions) error {
+	opts.WithScore = true
+	cols := columnsFor(opts)
+	bw := bufio.NewWriter(w)
+	bw.WriteString("[")
+	for i, r := range rows {
+		b, err := marshalRowJSON(r, cols)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			bw.WriteString(",")
+		}
+		bw.WriteString("\n  ")
+		bw.Write(b)
+	}
+	if len(rows) > 0 {
+		bw.WriteString("\n")
+	}
+	bw.WriteString("]\n")
+	return bw.Flush()
+}
+
+// --format ndjson: json と同じオブジェクトを 1 行に 1 つずつ書く。配列全体を組み立てずに行ごとに書き出す
+func writeNDJSON(w io.Writer, rows []row, opts outputOptions) error {
+	opts.WithScore = true
+	cols := columnsFor(opts)
+	for _, r := range rows {
+		b, err := marshalRowJSON(r, cols)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(append(b, '\n')); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 1 つの出力先 (Path が空なら stdout) に書く行と列設定
+type outputPart struct {
+	Path string
+	Rows []row
+	Opts outputOptions
+}
+
+// rows を n 行ずつに分け、path の拡張子の前に -1, -2, ... を付けたファイルに割り当てる。
+// 合計行とフッターは最後のファイルにだけ書く
+func splitOutput(path string, rows []row, opts outputOptions, n int) []outputPart {
+	ext := filepath.Ext(path)
+	stem := strings.TrimSuffix(path, ext)
+	var parts []outputPart
+	for i := 0; i == 0 || i < len(rows); i += n {
+		end := i + n
+		if end > len(rows) {
+			end = len(rows)
+		}
+		o := opts
+		o.GrandTotal = nil
+		o.Footer = nil
+		parts = append(parts, outputPart{
+			Path: fmt.Sprintf("%s-%d%s", stem, len(parts)+1, ext),
+			Rows: rows[i:end],
+			Opts: o,
+		})
+	}
+	parts[len(parts)-1].Opts.GrandTotal = opts.GrandTotal
+	parts[len(parts)-1].Opts.Footer = opts.Footer
+	return parts
+}
+
+func writeFormatted(w io.Writer, format string, rows []row, opts outputOptions, generatedAt time.Time) error {
+	switch format {
+	case "treemap-json":
+		return writeTreemapJSON(w, rows)
+	case "openmetrics":
+		return writeOpenMetrics(w, rows, opts, generatedAt)
+	case "json":
+		return writeJSON(w, rows, opts)
+	case "ndjson":
+		return writeNDJSON(w, rows, opts)
+	case "markdown":
+		return writeMarkdown(w, rows, opts)
+	case "html":
+		return writeHTML(w, rows, opts, generatedAt)
+	default:
+		return writeCSV(w, rows, opts)
+	}
+}
+
+// Path があれば同じディレクトリの一時ファイルに書いてから rename する（途中で落ちても壊れたファイルを残さない）
+func writeOutputFile(p outputPart, format string, tee bool, generatedAt time.Time) error {
+	if p.Path == "" {
+		return writeFormatted(os.Stdout, format, p.Rows, p.Opts, generatedAt)
+	}
+	f, err := createAtomic(p.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Abort()
+	var w io.Writer = f
+	if tee {
+		w = io.MultiWriter(f, os.Stdout)
+	}
+	if err := writeFormatted(w, format, p.Rows, p.Opts, generatedAt); err != nil {
+		return err
+	}
+	return f.Commit()
+}
+
+// --stream: repo ごとの行を走査が終わった順に書き足す。--out は一時ファイルを経由せず直接書く
+// (実行中に tail -f で追えるように。途中で落ちると書きかけのファイルが残る)
+type rowStreamer struct {
+	f      *os.File // nil なら stdout だけに書く
+	w      io.Writer
+	cw     *csv.Writer
+	format string
+	cols   []column
+}
+
+// ヘッダー行 (csv) を書いて返す。format は csv か ndjson
+func newRowStreamer(path, format string, tee bool, opts outputOptions) (*rowStreamer, error) {
+	s := &rowStreamer{w: os.Stdout, format: format}
+	if path != "" {
+		f, err := os.Create(path)
+		if err != nil {
+			return nil, err
+		}
+		s.f, s.w = f, f
+		if tee {
+			s.w = io.MultiWriter(f, os.Stdout)
+		}
+	}
+	if format == "ndjson" {
+		opts.WithScore = true
+		s.cols = columnsFor(opts)
+		return s, nil
+	}
+	s.cols = columnsFor(opts)
+	s.cw = csv.NewWriter(s.w)
+	header := make([]string, len(s.cols))
+	for i, c := range s.cols {
+		header[i] = c.Name
+	}
+	_ = s.cw.Write(header)
+	return s, s.flush()
+}
+
+func (s *rowStreamer) flush() error {
+	if s.cw == nil {
+		return nil
+	}
+	s.cw.Flush()
+	return s.cw.Error()
+}
+
+// 1 repo 分の行を書いてすぐ flush する
+func (s *rowStreamer) write(rows []row) error {
+	for _, r := range rows {
+		if s.cw == nil {
+			b, err := marshalRowJSON(r, s.cols)
+			if err != nil {
+				return err
+			}
+			if _, err := s.w.Write(append(b, '\n')); err != nil {
+				return err
+			}
+			continue
+		}
+		rec := make([]string, len(s.cols))
+		for i, c := range s.cols {
+			rec[i] = formatCell(c.Value(r))
+		}
+		_ = s.cw.Write(rec)
+	}
+	return s.flush()
+}
+
+// 合計行とフッター (csv のみ) を書いて閉じる
+func (s *rowStreamer) close(opts outputOptions) error {
+	if s.cw != nil {
+		if t := opts.GrandTotal; t != nil {
+			_ = s.cw.Write(grandTotalRecord(s.cols, *t))
+		}
+		if err := s.flush(); err != nil {
+			return err
+		}
+		for _, line := range opts.Footer {
+			if _, err := fmt.Fprintf(s.w, "# %s\n", line); err != nil {
+				return err
+			}
+		}
+	}
+	if s.f != nil {
+		return s.f.Close()
+	}
+	return nil
+}
+
+// D3 (d3.hierarchy) / ECharts の treemap がそのまま読める形式。
+// 親ノードの value は子の合計で、leaf (user) の value は touched lines (score)。
+type treemapNode struct {
+	Name     string         `json:"name"`
+	Value    int            `json:"value"`
+	Children []*treemapNode `json:"children,omitempty"`
+}
+
+// org → repo → user の階層にまとめる (--bucket では user の下に期間を置く)。子の並びは rows の順序を保つ
+func buildTreemap(rows []row) []*treemapNode {
+	var orgs []*treemapNode
+	orgIdx := map[string]*treemapNode{}
+	repoIdx := map[[2]string]*treemapNode{}
+	userIdx := map[[3]string]*treemapNode{}
+	for _, r := range rows {
+		o := orgIdx[r.Org]
+		if o == nil {
+			o = &treemapNode{Name: r.Org}
+			orgIdx[r.Org] = o
+			orgs = append(orgs, o)
+		}
+		rk := [2]string{r.Org, r.Repo}
+		rp := repoIdx[rk]
+		if rp == nil {
+			rp = &treemapNode{Name: r.Repo}
+			repoIdx[rk] = rp
+			o.Children = append(o.Children, rp)
+		}
+		if r.Period == "" {
+			rp.Children = append(rp.Children, &treemapNode{Name: r.User, Value: r.Score})
+		} else {
+			uk := [3]string{r.Org, r.Repo, r.User}
+			u := userIdx[uk]
+			if u == nil {
+				u = &treemapNode{Name: r.User}
+				userIdx[uk] = u
+				rp.Children = append(rp.Children, u)
+			}
+			u.Children = append(u.Children, &treemapNode{Name: r.Period, Value: r.Score})
+			u.Value += r.Score
+		}
+		rp.Value += r.Score
+		o.Value += r.Score
+	}
+	return orgs
+}
+
+func writeTreemapJSON(w io.Writer, rows []row) error {
+	orgs := buildTreemap(rows)
+	var root interface{} = orgs
+	if len(orgs) == 1 {
+		root = orgs[0]
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(root)
+}
+
+// OpenMetrics テキスト形式。各サンプルにスキャン時刻 (秒) をタイムスタンプとして付け、
+// 過去のスナップショットを TSDB にバックフィルできるようにする
+// ラベルは行を一意に決める列だけにする (同じ系列に同じ時刻のサンプルを複数出さない)。
+// --by-team は org,team、それ以外は org,repo,user に、--identity-map のチームと --bucket の期間を加える
+func writeOpenMetrics(w io.Writer, rows []row, opts outputOptions, generatedAt time.Time) error {
+	type label struct {
+		name  string
+		value func(r row) string
+	}
+	labels := []label{{"org", func(r row) string { return r.Org }}}
+	if opts.ByTeam {
+		labels = append(labels, label{"team", func(r row) string { return r.Team }})
+	} else {
+		labels = append(labels,
+			label{"repo", func(r row) string { return r.Repo }},
+			label{"user", func(r row) string { return r.User }},
+		)
+		if opts.WithTeam {
+			labels = append(labels, label{"team", func(r row) string { return r.Team }})
+		}
+	}
+	if opts.WithPeriod {
+		labels = append(labels, label{"period", func(r row) string { return r.Period }})
+	}
+	prs := describeStates(opts.Meta.States) + " PRs"
+	metrics := []struct {
+		name, help string
+		value      func(r row) int
+	}{
+		{"pr_lines_additions", "Lines added by " + prs + " in the scan window.", func(r row) int { return r.Additions }},
+		{"pr_lines_deletions", "Lines deleted by " + prs + " in the scan window.", func(r row) int { return r.Deletions }},
+		{"pr_lines_prs", "Number of " + prs + " in the scan window.", func(r row) int { return r.PRs }},
+		{"pr_lines_score", "Score in the scan window (--score-mode; default touched lines, additions + |deletions|).", func(r row) int { return r.Score }},
+	}
+	ts := fmt.Sprintf("%d.%03d", generatedAt.Unix(), generatedAt.Nanosecond()/int(time.Millisecond))
+	for _, m := range metrics {
+		if _, err := fmt.Fprintf(w, "# TYPE %s gauge\n# HELP %s %s\n", m.name, m.name, m.help); err != nil {
+			return err
+		}
+		for _, r := range rows {
+			pairs := make([]string, len(labels))
+			for i, l := range labels {
+				pairs[i] = fmt.Sprintf("%s=\"%s\"", l.name, escapeLabel(l.value(r)))
+			}
+			if _, err := fmt.Fprintf(w, "%s{%s} %d %s\n", m.name, strings.Join(pairs, ","), m.value(r), ts); err != nil {
+				return err
+			}
+		}
+	}
+	_, err := io.WriteString(w, "# EOF\n")
+	return err
+}
+
+// --states の値を HELP 用に "merged" / "merged or open" などにする (未指定は merged)
+func describeStates(states []string) string {
+	if len(states) == 0 {
+		return "merged"
+	}
+	words := make([]string, len(states))
+	for i, s := range states {
+		switch s {
+		case "CLOSED":
+			words[i] = "closed-unmerged"
+		default:
+			words[i] = strings.ToLower(s)
+		}
+	}
+	return strings.Join(words, " or ")
+}
+
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+// 1 PR = 1 行の生データ。外部で任意の集計をやり直せるよう、集計に使う値をすべて含める
+func writeRawCSV(w io.Writer, repos []repoRef, repoAggs map[repoRef]map[string]*agg) error {
+	cw := csv.NewWriter(w)
+	_ = cw.Write([]string{"org", "repo", "number", "user", "state", "base_ref", "created_at", "merged_at", "additions", "deletions"})
+	for _, repo := range repos {
+		var prs []prNode
+		users := map[int]string{}
+		for user, a := range repoAggs[repo] {
+			for _, n := range a.Raw {
+				prs = append(prs, n)
+				users[n.Number] = user
+			}
+		}
+		sort.Slice(prs, func(i, j int) bool { return prs[i].Number < prs[j].Number })
+		for _, n := range prs {
+			_ = cw.Write([]string{
+				repo.Org, repo.Name,
+				fmt.Sprintf("%d", n.Number),
+				users[n.Number],
+				n.State,
+				n.BaseRefName,
+				fmtRawTime(n.CreatedAt),
+				fmtRawTime(n.MergedAt),
+				fmt.Sprintf("%d", n.Additions),
+				fmt.Sprintf("%d", n.Deletions),
+			})
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func fmtRawTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func writeRawFile(path string, repos []repoRef, repoAggs map[repoRef]map[string]*agg) error {
+	f, err := createAtomic(path)
+	if err != nil {
+		return err
+	}
+	defer f.Abort()
+	if err := writeRawCSV(f, repos, repoAggs); err != nil {
+		return err
+	}
+	return f.Commit()
+}
+
+// カレンダー型ヒートマップ用: {"alice": {"2024-01-02": 120, ...}, ...}。PR がなかった日は含めない
+func writeHeatmapFile(path string, totals map[string]*agg) error {
+	heat := make(map[string]map[string]int, len(totals))
+	for user, a := range totals {
+		heat[user] = a.Daily
+	}
+	f, err := createAtomic(path)
+	if err != nil {
+		return err
+	}
+	defer f.Abort()
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(heat); err != nil {
+		return err
+	}
+	return f.Commit()
+}
+
+// org ごとの著者の合算 (org,user,additions,deletions,prs,score) を score 降順で書く (score は --score-mode / --score-bucket に従う)
+func writeTotalsFile(path string, repos []repoRef, repoAggs map[repoRef]map[string]*agg, scoreBucket int) error {
+	type key struct{ org, user string }
+	totals := map[key]*agg{}
+	for _, repo := range repos {
+		for user, a := range repoAggs[repo] {
+			k := key{repo.Org, user}
+			t := totals[k]
+			if t == nil {
+				t = &agg{}
+				totals[k] = t
+			}
+			t.merge(a)
+		}
+	}
+	rows := make([]row, 0, len(totals))
+	for k, a := range totals {
+		rows = append(rows, row{
+			Org:       k.org,
+			User:      k.user,
+			Additions: a.Additions,
+			Deletions: a.Deletions,
+			PRs:       a.PRs,
+			Score:     bucketScore(scoreOf(a.Additions, a.Deletions), scoreBucket),
+		})
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		return compareRows(rows[i], rows[j], []sortKey{{"score", true}, {"user", false}, {"org", false}}) < 0
+	})
+
+	f, err := createAtomic(path)
+	if err != nil {
+		return err
+	}
+	defer f.Abort()
+	cw := csv.NewWriter(f)
+	_ = cw.Write([]string{"org", "user", "additions", "deletions", "prs", "score"})
+	for _, r := range rows {
+		_ = cw.Write([]string{r.Org, r.User, fmt.Sprintf("%d", r.Additions), fmt.Sprintf("%d", r.Deletions), fmt.Sprintf("%d", r.PRs), fmt.Sprintf("%d", r.Score)})
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return err
+	}
+	return f.Commit()
+}
+
+// リポジトリ単位の最終マージ日。対象期間に PR がなかった repo も空欄で含め、古い順 (空欄が先頭) に並べる。
+// qualified なら repo 列を "org/name" にする (複数 org のとき)
+func writeRepoActivityFile(path string, repos []repoRef, repoAggs map[repoRef]map[string]*agg, qualified bool) error {
+	type activity struct {
+		repo string
+		last time.Time
+		prs  int
+	}
+	acts := make([]activity, 0, len(repos))
+	labels := repoLabels(repos, qualified)
+	for i, repo := range repos {
+		a := activity{repo: labels[i]}
+		for _, t := range repoAggs[repo] {
+			a.prs += t.PRs
+			if t.LastMerged.After(a.last) {
+				a.last = t.LastMerged
+			}
+		}
+		acts = append(acts, a)
+	}
+	sort.SliceStable(acts, func(i, j int) bool { return acts[i].last.Before(acts[j].last) })
+
+	f, err := createAtomic(path)
+	if err != nil {
+		return err
+	}
+	defer f.Abort()
+	cw := csv.NewWriter(f)
+	_ = cw.Write([]string{"repo", "last_merged_at", "total_prs"})
+	for _, a := range acts {
+		_ = cw.Write([]string{a.repo, fmtRawTime(a.last), fmt.Sprintf("%d", a.prs)})
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return err
+	}
+	return f.Commit()
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteOpenMetricsLabels(t *testing.T) {
+	at := time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		rows []row
+		opts outputOptions
+		want []string
+	}{
+		{
+			"default",
+			[]row{{Org: "acme", Repo: "r1", User: "alice", Additions: 10}},
+			outputOptions{},
+			[]string{
+				`# HELP pr_lines_additions Lines added by merged PRs in the scan window.`,
+				`pr_lines_additions{org="acme",repo="r1",user="alice"} 10 1711929600.000`,
+			},
+		},
+		{
+			"--bucket",
+			[]row{
+				{Org: "acme", Repo: "r1", User: "alice", Period: "2024-01", Additions: 10},
+				{Org: "acme", Repo: "r1", User: "alice", Period: "2024-02", Additions: 3},
+			},
+			outputOptions{WithPeriod: true},
+			[]string{
+				`pr_lines_additions{org="acme",repo="r1",user="alice",period="2024-01"} 10 1711929600.000`,
+				`pr_lines_additions{org="acme",repo="r1",user="alice",period="2024-02"} 3 1711929600.000`,
+			},
+		},
+		{
+			"--by-team",
+			[]row{{Org: "acme", Team: "core", Additions: 4}, {Org: "acme", Team: "web", Additions: 6}},
+			outputOptions{ByTeam: true},
+			[]string{
+				`pr_lines_additions{org="acme",team="core"} 4 1711929600.000`,
+				`pr_lines_additions{org="acme",team="web"} 6 1711929600.000`,
+			},
+		},
+		{
+			"--states",
+			[]row{{Org: "acme", Repo: "r1", User: "alice"}},
+			outputOptions{Meta: reportMeta{States: []string{"MERGED", "OPEN"}}},
+			[]string{
+				`# HELP pr_lines_additions Lines added by merged or open PRs in the scan window.`,
+				`# HELP pr_lines_prs Number of merged or open PRs in the scan window.`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := writeOpenMetrics(&buf, tt.rows, tt.opts, at); err != nil {
+				t.Fatal(err)
+			}
+			for _, w := range tt.want {
+				if !strings.Contains(buf.String(), w+"\n") {
+					t.Errorf("missing %q in:\n%s", w, buf.String())
+				}
+			}
+		})
+	}
+}
+
+func TestBuildTreemapNestsPeriods(t *testing.T) {
+	rows := []row{
+		{Org: "acme", Repo: "r1", User: "alice", Period: "2024-01", Score: 10},
+		{Org: "acme", Repo: "r1", User: "bob", Period: "2024-01", Score: 4},
+		{Org: "acme", Repo: "r1", User: "alice", Period: "2024-02", Score: 5},
+	}
+	orgs := buildTreemap(rows)
+	if len(orgs) != 1 || orgs[0].Value != 19 || len(orgs[0].Children) != 1 {
+		t.Fatalf("orgs = %+v", orgs)
+	}
+	repo := orgs[0].Children[0]
+	if repo.Value != 19 || len(repo.Children) != 2 {
+		t.Fatalf("repo r1 = %+v, want value 19 with 2 users", repo)
+	}
+	alice := repo.Children[0]
+	if alice.Name != "alice" || alice.Value != 15 || len(alice.Children) != 2 {
+		t.Fatalf("alice = %+v, want value 15 with 2 periods", alice)
+	}
+	if p := alice.Children[1]; p.Name != "2024-02" || p.Value != 5 {
+		t.Errorf("alice period = %+v", p)
+	}
+	// --bucket なしは user が leaf
+	flat := buildTreemap([]row{{Org: "acme", Repo: "r1", User: "alice", Score: 3}})
+	if u := flat[0].Children[0].Children[0]; u.Name != "alice" || u.Value != 3 || u.Children != nil {
+		t.Errorf("leaf = %+v", u)
+	}
+}
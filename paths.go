@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+type prFile struct {
+	Path      string `json:"path"`
+	Additions int    `json:"additions"`
+	Deletions int    `json:"deletions"`
+}
+
+// gitignore 風のパターン。'/' を含まなければファイル名、含めばリポジトリルートからのパスに対して照合する
+type pathPattern struct {
+	re       *regexp.Regexp
+	basename bool
+}
+
+func compilePathPattern(p string) (pathPattern, error) {
+	anchored := strings.Contains(strings.TrimSuffix(p, "/"), "/")
+	p = strings.TrimPrefix(p, "/")
+	re, err := regexp.Compile("^" + globToRegexp(p) + "$")
+	if err != nil {
+		return pathPattern{}, err
+	}
+	return pathPattern{re: re, basename: !anchored}, nil
+}
+
+func (p pathPattern) match(file string) bool {
+	if p.basename {
+		return p.re.MatchString(path.Base(file))
+	}
+	return p.re.MatchString(file)
+}
+
+// "**" は '/' をまたいで任意、"*" と "?" は '/' 以外に一致する
+func globToRegexp(g string) string {
+	var b strings.Builder
+	for i := 0; i < len(g); i++ {
+		c := g[i]
+		switch {
+		case strings.HasPrefix(g[i:], "**/"):
+			b.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(g[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[':
+			if j := strings.IndexByte(g[i:], ']'); j > 0 {
+				class := g[i+1 : i+j]
+				if strings.HasPrefix(class, "!") {
+					class = "^" + class[1:]
+				}
+				b.WriteString("[" + class + "]")
+				i += j
+			} else {
+				b.WriteString(`\[`)
+			}
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return b.String()
+}
+
+// linguist-generated が付いたパターン。後に書かれた行が優先される (gitattributes と同じ)
+type generatedRules struct {
+	patterns []pathPattern
+	values   []bool
+}
+
+func parseGitattributes(text string) generatedRules {
+	var g generatedRules
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		for _, attr := range fields[1:] {
+			var v, ok bool
+			switch attr {
+			case "linguist-generated", "linguist-generated=true":
+				v, ok = true, true
+			case "-linguist-generated", "linguist-generated=false", "!linguist-generated":
+				v, ok = false, true
+			}
+			if !ok {
+				continue
+			}
+			p, err := compilePathPattern(fields[0])
+			if err != nil {
+				continue
+			}
+			g.patterns = append(g.patterns, p)
+			g.values = append(g.values, v)
+		}
+	}
+	return g
+}
+
+func (g generatedRules) isGenerated(file string) bool {
+	gen := false
+	for i, p := range g.patterns {
+		if p.match(file) {
+			gen = g.values[i]
+		}
+	}
+	return gen
+}
+
+type blobResp struct {
+	Data struct {
+		Repository struct {
+			Object *struct {
+				Text string `json:"text"`
+			} `json:"object"`
+		} `json:"repository"`
+	} `json:"data"`
+	Errors []gqlError `json:"errors"`
+}
+
+// デフォルトブランチの .gitattributes。存在しなければ空文字。
+// エラーは PR の取得と同じく分類する (FORBIDDEN / NOT_FOUND は呼び出し側で skip、レート制限は待って取り直す)
+func fetchGitattributes(ctx context.Context, endpoint, token, owner, repo string) (string, error) {
+	const q = `
+query Gitattributes($owner:String!, $name:String!) {
+  repository(owner:$owner, name:$name) {
+    object(expression:"HEAD:.gitattributes") { ... on Blob { text } }
+  }
+}`
+	rateRetries := 0
+	for {
+		b, err := doGraphQL(ctx, endpoint, token, q, map[string]interface{}{"owner": owner, "name": repo})
+		if err != nil {
+			return "", fmt.Errorf("repo %s/%s .gitattributes: %w", owner, repo, err)
+		}
+		var out blobResp
+		if err := json.Unmarshal(b, &out); err != nil {
+			return "", err
+		}
+		if len(out.Errors) > 0 {
+			if retry, err := waitGQLRateLimit(ctx, owner+"/"+repo, out.Errors, &rateRetries); err != nil {
+				return "", err
+			} else if retry {
+				continue
+			}
+			if hasForbiddenError(out.Errors) {
+				return "", fmt.Errorf("%w: %v", errNoPRAccess, joinGQLErrors(out.Errors))
+			}
+			if hasNotFoundError(out.Errors) {
+				return "", fmt.Errorf("%w: %v", errRepoNotFound, joinGQLErrors(out.Errors))
+			}
+			return "", joinGQLErrors(out.Errors)
+		}
+		if out.Data.Repository.Object == nil {
+			return "", nil
+		}
+		return out.Data.Repository.Object.Text, nil
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+type projectResp struct {
+	Data struct {
+		Organization struct {
+			ProjectV2 *struct {
+				Title string `json:"title"`
+				Items struct {
+					PageInfo pageInfo `json:"pageInfo"`
+					Nodes    []struct {
+						Content *struct {
+							Typename string `json:"__typename"`
+							prNode
+							Repository struct {
+								Name  string `json:"name"`
+								Owner struct {
+									Login string `json:"login"`
+								} `json:"owner"`
+							} `json:"repository"`
+						} `json:"content"`
+					} `json:"nodes"`
+				} `json:"items"`
+			} `json:"projectV2"`
+		} `json:"organization"`
+	} `json:"data"`
+	Errors []gqlError `json:"errors"`
+}
+
+// org の ProjectV2 (番号指定) に載っている PR をリポジトリ横断で集計する。
+// 戻り値は repo -> login -> agg。org 外のリポジトリは "owner/name" をキーにする
+func fetchProjectPRAgg(ctx context.Context, endpoint, token, org string, number int, filter prFilter) (map[string]map[string]*agg, []string, error) {
+	const q = `
+query ProjectPullRequests($org:String!, $number:Int!, $cursor:String, $threads:Boolean!, $files:Boolean!, $labels:Boolean!, $reviews:Boolean!) {
+  organization(login:$org) {
+    projectV2(number:$number) {
+      title
+      items(first: 100, after: $cursor) {
+        pageInfo { hasNextPage endCursor }
+        nodes {
+          content {
+            __typename
+            ... on PullRequest {
+              ...prFields
+              repository { name owner { login } }
+            }
+          }
+        }
+      }
+    }
+  }
+}` + prFieldsFragment
+	repoAggs := map[string]map[string]*agg{}
+	// --respect-gitattributes: リポジトリごとに 1 回だけ .gitattributes を取得する
+	generated := map[string]generatedRules{}
+	rulesFor := func(owner, name string) (generatedRules, error) {
+		if !filter.RespectGitattributes {
+			return generatedRules{}, nil
+		}
+		key := owner + "/" + name
+		if r, ok := generated[key]; ok {
+			return r, nil
+		}
+		text, err := fetchGitattributes(ctx, endpoint, token, owner, name)
+		if err != nil {
+			return generatedRules{}, fmt.Errorf("project %s#%d: %s: %w", org, number, key, err)
+		}
+		generated[key] = parseGitattributes(text)
+		return generated[key], nil
+	}
+	var cursor *string
+	for {
+		vars := map[string]interface{}{
+			"org":     org,
+			"number":  number,
+			"threads": filter.RequireResolvedThreads,
+			"files":   filter.needsFiles(),
+			"labels":  filter.needsLabels(),
+			"reviews": filter.IncludeReviews,
+			"cursor": func() interface{} {
+				if cursor == nil {
+					return nil
+				}
+				return *cursor
+			}(),
+		}
+		b, err := doGraphQL(ctx, endpoint, token, q, vars)
+		if err != nil {
+			return nil, nil, fmt.Errorf("project %s#%d: %w", org, number, err)
+		}
+		var out projectResp
+		if err := json.Unmarshal(b, &out); err != nil {
+			return nil, nil, err
+		}
+		if len(out.Errors) > 0 {
+			return nil, nil, fmt.Errorf("project %s#%d: %w (the token needs the read:project scope)", org, number, joinGQLErrors(out.Errors))
+		}
+		p := out.Data.Organization.ProjectV2
+		if p == nil {
+			return nil, nil, fmt.Errorf("project %s#%d not found or not visible to this token", org, number)
+		}
+		for _, item := range p.Items.Nodes {
+			c := item.Content
+			// Issue / DraftIssue と --states にない PR は対象外
+			if c == nil || c.Typename != "PullRequest" || !filter.wantsState(c.State) {
+				continue
+			}
+			repo := c.Repository.Name
+			if c.Repository.Owner.Login != org {
+				repo = c.Repository.Owner.Login + "/" + c.Repository.Name
+			}
+			totals := repoAggs[repo]
+			if totals == nil {
+				totals = map[string]*agg{}
+				repoAggs[repo] = totals
+			}
+			rules, err := rulesFor(c.Repository.Owner.Login, c.Repository.Name)
+			if err != nil {
+				return nil, nil, err
+			}
+			accumulatePR(totals, c.Repository.Owner.Login, c.Repository.Name, c.prNode, filter, rules)
+		}
+		if !p.Items.PageInfo.HasNextPage {
+			break
+		}
+		next := p.Items.PageInfo.EndCursor
+		cursor = &next
+	}
+	repos := make([]string, 0, len(repoAggs))
+	for r := range repoAggs {
+		repos = append(repos, r)
+	}
+	sort.Strings(repos)
+	return repoAggs, repos, nil
+}
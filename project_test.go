@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestFetchProjectPRAggRespectsGitattributes(t *testing.T) {
+	quietGlobals(t)
+	const item = `{"content":{"__typename":"PullRequest","number":1,"state":"MERGED","mergedAt":"2024-01-02T00:00:00Z","additions":110,"deletions":5,"changedFiles":2,
+  "author":{"login":"alice"},"repository":{"name":"r1","owner":{"login":"acme"}},
+  "files":{"nodes":[{"path":"main.go","additions":10,"deletions":5},{"path":"gen/api.pb.go","additions":100,"deletions":0}]}}}`
+	f, endpoint := newFakeGraphQL(t, func(_ int, req graphQLRequest) (int, string) {
+		switch operationName(req.Query) {
+		case "ProjectPullRequests":
+			return http.StatusOK, `{"data":{"organization":{"projectV2":{"title":"p","items":{"pageInfo":{"hasNextPage":false,"endCursor":""},"nodes":[` + item + `,` + item + `]}}}}}`
+		case "Gitattributes":
+			return http.StatusOK, `{"data":{"repository":{"object":{"text":"gen/** linguist-generated\n"}}}}`
+		}
+		return http.StatusBadRequest, `unexpected query`
+	})
+	repoAggs, _, err := fetchProjectPRAgg(context.Background(), endpoint, "tok", "acme", 1, prFilter{RespectGitattributes: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := repoAggs["r1"]["alice"]
+	if a == nil || a.Additions != 20 || a.Deletions != 10 {
+		t.Errorf("alice = %+v, want generated lines excluded (additions 20, deletions 10)", a)
+	}
+	gitattributes := 0
+	for _, r := range f.requests() {
+		if operationName(r.Query) == "Gitattributes" {
+			gitattributes++
+		}
+		if operationName(r.Query) == "ProjectPullRequests" && r.Variables["files"] != true {
+			t.Errorf("files = %v, want true", r.Variables["files"])
+		}
+	}
+	if gitattributes != 1 {
+		t.Errorf(".gitattributes fetched %d times, want once per repo", gitattributes)
+	}
+}
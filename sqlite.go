@@ -0,0 +1,52 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+
+	_ "modernc.org/sqlite" // cgo 不要の SQLite ドライバ
+)
+
+// 実行ごとに行を追記していくので、scanned_at で過去のスキャンと区別する
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS pr_stats (
+  org        TEXT,
+  repo       TEXT,
+  user       TEXT,
+  additions  INT,
+  deletions  INT,
+  prs        INT,
+  score      INT,
+  scanned_at TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS pr_stats_org_user ON pr_stats (org, user);`
+
+// rows を path の SQLite DB の pr_stats に1トランザクションで追記する。DB がなければ作る
+func writeSQLite(path string, rows []row, scannedAt time.Time) error {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(`INSERT INTO pr_stats (org, repo, user, additions, deletions, prs, score, scanned_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	// SQLite の日付関数がそのまま読める RFC3339 (UTC) で保存する
+	at := scannedAt.UTC().Format(time.RFC3339)
+	for _, r := range rows {
+		if _, err := stmt.Exec(r.Org, r.Repo, r.User, r.Additions, r.Deletions, r.PRs, r.Score, at); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// チームに属さない login をまとめる名前 (--by-team)
+const noTeam = "(no team)"
+
+type pageOfLogins struct {
+	PageInfo pageInfo `json:"pageInfo"`
+	Nodes    []struct {
+		Login string `json:"login"`
+	} `json:"nodes"`
+}
+
+type orgTeamsResp struct {
+	Data struct {
+		Organization *struct {
+			Teams struct {
+				PageInfo pageInfo `json:"pageInfo"`
+				Nodes    []struct {
+					Slug    string       `json:"slug"`
+					Members pageOfLogins `json:"members"`
+				} `json:"nodes"`
+			} `json:"teams"`
+		} `json:"organization"`
+	} `json:"data"`
+	Errors []gqlError `json:"errors"`
+}
+
+type teamMembersResp struct {
+	Data struct {
+		Organization *struct {
+			Team *struct {
+				Members pageOfLogins `json:"members"`
+			} `json:"team"`
+		} `json:"organization"`
+	} `json:"data"`
+	Errors []gqlError `json:"errors"`
+}
+
+// チーム一覧は read:org スコープがないと FORBIDDEN / INSUFFICIENT_SCOPES になる
+func teamsError(org string, errs []gqlError) error {
+	for _, e := range errs {
+		if strings.EqualFold(e.Type, "FORBIDDEN") || strings.EqualFold(e.Type, "INSUFFICIENT_SCOPES") {
+			return fmt.Errorf("teams of %s: %w (--by-team needs a token with the read:org scope)", org, joinGQLErrors(errs))
+		}
+	}
+	return fmt.Errorf("teams of %s: %w", org, joinGQLErrors(errs))
+}
+
+// org の全チームのメンバー (子チームのメンバーを含む) から login (小文字) -> チーム slug (昇順) を作る
+func fetchOrgTeams(ctx context.Context, endpoint, token, org string) (map[string][]string, error) {
+	const q = `
+query OrgTeams($org:String!, $cursor:String) {
+  organization(login:$org) {
+    teams(first:100, after:$cursor) {
+      pageInfo { hasNextPage endCursor }
+      nodes {
+        slug
+        members(first:100) { pageInfo { hasNextPage endCursor } nodes { login } }
+      }
+    }
+  }
+}`
+	teamsOf := map[string][]string{}
+	add := func(slug string, members pageOfLogins) {
+		for _, n := range members.Nodes {
+			login := strings.ToLower(n.Login)
+			teamsOf[login] = append(teamsOf[login], slug)
+		}
+	}
+	var cursor interface{}
+	for {
+		b, err := doGraphQL(ctx, endpoint, token, q, map[string]interface{}{"org": org, "cursor": cursor})
+		if err != nil {
+			return nil, err
+		}
+		var out orgTeamsResp
+		if err := json.Unmarshal(b, &out); err != nil {
+			return nil, err
+		}
+		if len(out.Errors) > 0 {
+			return nil, teamsError(org, out.Errors)
+		}
+		o := out.Data.Organization
+		if o == nil {
+			return nil, fmt.Errorf("%s is not an organization visible to this token (--by-team needs org teams)", org)
+		}
+		for _, t := range o.Teams.Nodes {
+			add(t.Slug, t.Members)
+			if t.Members.PageInfo.HasNextPage {
+				rest, err := fetchTeamMembers(ctx, endpoint, token, org, t.Slug, t.Members.PageInfo.EndCursor)
+				if err != nil {
+					return nil, err
+				}
+				add(t.Slug, rest)
+			}
+		}
+		if !o.Teams.PageInfo.HasNextPage {
+			break
+		}
+		cursor = o.Teams.PageInfo.EndCursor
+	}
+	for _, slugs := range teamsOf {
+		sort.Strings(slugs)
+	}
+	return teamsOf, nil
+}
+
+// 100 人を超えるチームの残りのメンバー
+func fetchTeamMembers(ctx context.Context, endpoint, token, org, slug, after string) (pageOfLogins, error) {
+	const q = `
+query TeamMembers($org:String!, $slug:String!, $cursor:String) {
+  organization(login:$org) {
+    team(slug:$slug) {
+      members(first:100, after:$cursor) { pageInfo { hasNextPage endCursor } nodes { login } }
+    }
+  }
+}`
+	var all pageOfLogins
+	cursor := after
+	for {
+		b, err := doGraphQL(ctx, endpoint, token, q, map[string]interface{}{"org": org, "slug": slug, "cursor": cursor})
+		if err != nil {
+			return all, err
+		}
+		var out teamMembersResp
+		if err := json.Unmarshal(b, &out); err != nil {
+			return all, err
+		}
+		if len(out.Errors) > 0 {
+			return all, teamsError(org, out.Errors)
+		}
+		if out.Data.Organization == nil || out.Data.Organization.Team == nil {
+			return all, fmt.Errorf("team %s/%s not found", org, slug)
+		}
+		m := out.Data.Organization.Team.Members
+		all.Nodes = append(all.Nodes, m.Nodes...)
+		if !m.PageInfo.HasNextPage {
+			return all, nil
+		}
+		cursor = m.PageInfo.EndCursor
+	}
+}
+
+// login を数えるチーム。priority が空なら所属する全チーム、あれば priority で最初に一致する 1 チーム
+// (どれにも一致しなければ slug 昇順の先頭)。所属なしは (no team)
+func teamsFor(teamsOf map[string][]string, login string, priority []string) []string {
+	slugs := teamsOf[strings.ToLower(login)]
+	if len(slugs) == 0 {
+		return []string{noTeam}
+	}
+	if len(priority) == 0 {
+		return slugs
+	}
+	for _, p := range priority {
+		for _, s := range slugs {
+			if strings.EqualFold(p, s) {
+				return []string{s}
+			}
+		}
+	}
+	return slugs[:1]
+}
+
+// repo ごとの集計を org -> チーム -> agg にまとめ直す
+func aggregateByTeam(repos []repoRef, repoAggs map[repoRef]map[string]*agg, teams map[string]map[string][]string, priority []string) map[string]map[string]*agg {
+	out := map[string]map[string]*agg{}
+	for _, repo := range repos {
+		byTeam := out[repo.Org]
+		if byTeam == nil {
+			byTeam = map[string]*agg{}
+			out[repo.Org] = byTeam
+		}
+		for login, a := range repoAggs[repo] {
+			for _, t := range teamsFor(teams[repo.Org], login, priority) {
+				ta := byTeam[t]
+				if ta == nil {
+					ta = &agg{}
+					byTeam[t] = ta
+				}
+				ta.merge(a)
+			}
+		}
+	}
+	return out
+}